@@ -0,0 +1,341 @@
+// Package circuitbreaker stops calls to failing dependencies, using the circuit breaker rules from a service's
+// SentinelConfig.
+//
+// Each rule has a breaker for its resource. While it is closed, calls go ahead and their outcomes are counted over
+// a sliding interval; once enough of them are slow or fail, it opens and calls fail straight away with ErrOpen.
+// After the rule's retry timeout it is half-open, letting one probe call through at a time: it closes again after
+// enough successful probes, and opens again if a probe fails. Resources are usually downstream services, which
+// Transport and the gRPC interceptors map calls to.
+package circuitbreaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// ErrOpen is returned, wrapped with the resource's name, for calls refused by an open breaker.
+var ErrOpen = errors.New("circuit breaker open")
+
+// State is the state of a breaker.
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Event records a breaker changing state.
+type Event struct {
+	Rule     Rule
+	From, To State
+	// Value is the slow ratio, error ratio or error count which tripped the breaker, when it opens from Closed.
+	Value float64
+	Time  time.Time
+}
+
+// Breakers holds the breakers for every rule. It is safe for concurrent use.
+type Breakers struct {
+	onChange func(Event)
+
+	mu       sync.Mutex
+	breakers map[string][]*breaker // by resource
+}
+
+// Option configures Breakers.
+type Option func(*Breakers)
+
+// WithStateChange calls f whenever a breaker changes state. It must not call back into the Breakers.
+func WithStateChange(f func(Event)) Option {
+	return func(b *Breakers) {
+		b.onChange = f
+	}
+}
+
+// New returns Breakers with no rules, which allow every call until Update is called.
+func New(opts ...Option) *Breakers {
+	b := &Breakers{breakers: make(map[string][]*breaker)}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Update replaces the rules with those in cfg. Breakers for rules which are unchanged keep their state;
+// if cfg can't be parsed, the current rules are kept.
+func (b *Breakers) Update(cfg *pb.SentinelConfig) error {
+	rules, err := Parse(cfg)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	old := make(map[Rule]*breaker)
+	for _, brs := range b.breakers {
+		for _, br := range brs {
+			old[br.rule] = br
+		}
+	}
+	b.breakers = make(map[string][]*breaker)
+	for _, r := range rules {
+		br := old[r]
+		if br == nil {
+			br = newBreaker(r)
+		}
+		b.breakers[r.Resource] = append(b.breakers[r.Resource], br)
+	}
+	return nil
+}
+
+// Updater returns a function for serviceconfig.WithChange which updates the rules from every new version of the
+// service config, calling onErr, if it is set, when they can't be parsed.
+func (b *Breakers) Updater(onErr func(error)) func(version string, cfg *pb.ServiceConfig) {
+	return func(version string, cfg *pb.ServiceConfig) {
+		if err := b.Update(cfg.GetSentinelConfig()); err != nil && onErr != nil {
+			onErr(fmt.Errorf("service config %s: %w", version, err))
+		}
+	}
+}
+
+// Rules returns the rules in force.
+func (b *Breakers) Rules() []Rule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var rules []Rule
+	for _, brs := range b.breakers {
+		for _, br := range brs {
+			rules = append(rules, br.rule)
+		}
+	}
+	return rules
+}
+
+// State returns the state of the resource's breakers: Open if any is open, HalfOpen if any is half-open, and otherwise Closed.
+func (b *Breakers) State(resource string) State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := Closed
+	for _, br := range b.breakers[resource] {
+		switch {
+		case br.state == Open:
+			return Open
+		case br.state == HalfOpen:
+			state = HalfOpen
+		}
+	}
+	return state
+}
+
+// Allow reports whether a call to resource may go ahead, returning an error wrapping ErrOpen if not.
+// If it may, done must be called when the call has finished, saying whether it failed.
+func (b *Breakers) Allow(resource string) (done func(failed bool), err error) {
+	now := time.Now()
+	var events []Event
+
+	b.mu.Lock()
+	brs := b.breakers[resource]
+	probes := make([]bool, len(brs))
+	allowed := true
+	for i, br := range brs {
+		ok, probe, ev := br.allow(now)
+		if ev != nil {
+			events = append(events, *ev)
+		}
+		if !ok {
+			allowed = false
+			break
+		}
+		probes[i] = probe
+	}
+	if !allowed {
+		// Hand back any probes taken before the breaker which refused the call.
+		for i, probe := range probes {
+			if probe {
+				brs[i].probing = false
+			}
+		}
+	}
+	b.mu.Unlock()
+	b.emit(events)
+
+	if !allowed {
+		return nil, fmt.Errorf("%w for %s", ErrOpen, resource)
+	}
+	var once sync.Once
+	return func(failed bool) {
+		once.Do(func() {
+			end := time.Now()
+			var events []Event
+			b.mu.Lock()
+			for i, br := range brs {
+				if ev := br.done(end, end.Sub(now), failed, probes[i]); ev != nil {
+					events = append(events, *ev)
+				}
+			}
+			b.mu.Unlock()
+			b.emit(events)
+		})
+	}, nil
+}
+
+func (b *Breakers) emit(events []Event) {
+	if b.onChange == nil {
+		return
+	}
+	for _, ev := range events {
+		b.onChange(ev)
+	}
+}
+
+// breaker is the state of one rule. Its methods must be called with Breakers.mu held.
+type breaker struct {
+	rule    Rule
+	stats   *counter
+	state   State
+	retryAt time.Time
+	probing bool   // a probe call is in flight
+	probes  uint64 // successful probes since half-opening
+}
+
+func newBreaker(r Rule) *breaker {
+	return &breaker{rule: r, stats: newCounter(r.interval(), int(r.StatSlidingWindowBucketCount))}
+}
+
+// allow reports whether a call may go ahead, and whether it is a probe.
+func (br *breaker) allow(now time.Time) (ok, probe bool, ev *Event) {
+	switch br.state {
+	case Open:
+		if now.Before(br.retryAt) {
+			return false, false, nil
+		}
+		ev = br.set(HalfOpen, now, 0)
+		br.probing = true
+		return true, true, ev
+	case HalfOpen:
+		if br.probing {
+			return false, false, nil
+		}
+		br.probing = true
+		return true, true, nil
+	}
+	return true, false, nil
+}
+
+// done records the outcome of a call.
+func (br *breaker) done(now time.Time, rt time.Duration, failed, probe bool) *Event {
+	bad := failed
+	if br.rule.Strategy == SlowRequestRatio {
+		bad = rt > time.Duration(br.rule.MaxAllowedRtMs)*time.Millisecond
+	}
+
+	switch br.state {
+	case HalfOpen:
+		if !probe {
+			return nil
+		}
+		br.probing = false
+		if bad {
+			return br.set(Open, now, 0)
+		}
+		br.probes++
+		if br.probes >= max(br.rule.ProbeNum, 1) {
+			return br.set(Closed, now, 0)
+		}
+	case Closed:
+		br.stats.add(now, bad)
+		total, failures := br.stats.sum(now)
+		if total < float64(br.rule.MinRequestAmount) || total == 0 {
+			return nil
+		}
+		value := failures
+		if br.rule.Strategy != ErrorCount {
+			value = failures / total
+		}
+		if br.trips(value) {
+			return br.set(Open, now, value)
+		}
+	}
+	return nil
+}
+
+func (br *breaker) trips(value float64) bool {
+	if br.rule.Strategy == ErrorCount {
+		return value >= br.rule.Threshold
+	}
+	// A ratio can't exceed 1, so a threshold of 1 trips when every call is bad.
+	return value > br.rule.Threshold || value == 1 && br.rule.Threshold >= 1
+}
+
+func (br *breaker) set(to State, now time.Time, value float64) *Event {
+	ev := &Event{Rule: br.rule, From: br.state, To: to, Value: value, Time: now}
+	br.state = to
+	switch to {
+	case Open:
+		br.retryAt = now.Add(time.Duration(br.rule.RetryTimeoutMs) * time.Millisecond)
+	case HalfOpen:
+		br.probes = 0
+	case Closed:
+		br.stats.reset()
+	}
+	return ev
+}
+
+// counter counts calls and bad calls over a sliding interval, in buckets which are reset as the interval moves past them.
+type counter struct {
+	size    int64 // nanoseconds per bucket
+	buckets []counterBucket
+}
+
+type counterBucket struct {
+	start      int64
+	total, bad float64
+}
+
+func newCounter(interval time.Duration, buckets int) *counter {
+	buckets = max(buckets, 1)
+	return &counter{size: max(int64(interval)/int64(buckets), 1), buckets: make([]counterBucket, buckets)}
+}
+
+func (c *counter) add(now time.Time, bad bool) {
+	start := now.UnixNano() / c.size * c.size
+	b := &c.buckets[start/c.size%int64(len(c.buckets))]
+	if b.start != start {
+		*b = counterBucket{start: start}
+	}
+	b.total++
+	if bad {
+		b.bad++
+	}
+}
+
+func (c *counter) sum(now time.Time) (total, bad float64) {
+	oldest := now.UnixNano() - c.size*int64(len(c.buckets))
+	for _, b := range c.buckets {
+		if b.start > oldest {
+			total += b.total
+			bad += b.bad
+		}
+	}
+	return total, bad
+}
+
+func (c *counter) reset() {
+	clear(c.buckets)
+}
@@ -0,0 +1,141 @@
+package circuitbreaker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// retryTimeout is the RetryTimeoutMs of the rules in the tests.
+const retryTimeout = 50 * time.Millisecond
+
+func newBreakers(t *testing.T, rules string) *Breakers {
+	t.Helper()
+	b := New()
+	if err := b.Update(&pb.SentinelConfig{CircuitbreakerRulesJson: proto.String(rules)}); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		// Each step is one of: ok, fail or slow, for a call with that outcome; refused, for a call the breaker
+		// must refuse; hold, for a successful call which stays in flight until release; and wait, to sleep
+		// past the retry timeout.
+		steps  []string
+		states []State // after each step
+	}{
+		{
+			name:   "error count trips",
+			rule:   `{"strategy":2,"threshold":2,"minRequestAmount":1}`,
+			steps:  []string{"fail", "ok", "fail", "refused"},
+			states: []State{Closed, Closed, Open, Open},
+		},
+		{
+			name:   "error ratio waits for enough calls",
+			rule:   `{"strategy":1,"threshold":0.5,"minRequestAmount":3}`,
+			steps:  []string{"fail", "fail", "ok", "refused"},
+			states: []State{Closed, Closed, Open, Open},
+		},
+		{
+			name:   "error ratio must exceed the threshold",
+			rule:   `{"strategy":1,"threshold":0.5,"minRequestAmount":2}`,
+			steps:  []string{"ok", "fail", "fail"},
+			states: []State{Closed, Closed, Open},
+		},
+		{
+			name:   "slow calls",
+			rule:   `{"strategy":0,"threshold":0.4,"minRequestAmount":2,"maxAllowedRtMs":10}`,
+			steps:  []string{"fail", "fail", "slow", "slow"},
+			states: []State{Closed, Closed, Closed, Open},
+		},
+		{
+			name:   "probe succeeds",
+			rule:   `{"strategy":2,"threshold":1,"minRequestAmount":1}`,
+			steps:  []string{"fail", "refused", "wait", "ok", "ok"},
+			states: []State{Open, Open, Open, Closed, Closed},
+		},
+		{
+			name:   "probe fails",
+			rule:   `{"strategy":2,"threshold":1,"minRequestAmount":1}`,
+			steps:  []string{"fail", "wait", "fail", "refused", "wait", "ok"},
+			states: []State{Open, Open, Open, Open, Open, Closed},
+		},
+		{
+			name:   "one probe at a time",
+			rule:   `{"strategy":2,"threshold":1,"minRequestAmount":1}`,
+			steps:  []string{"fail", "wait", "hold", "refused", "release", "ok"},
+			states: []State{Open, Open, HalfOpen, HalfOpen, Closed, Closed},
+		},
+		{
+			name:   "several probes",
+			rule:   `{"strategy":2,"threshold":1,"minRequestAmount":1,"probeNum":2}`,
+			steps:  []string{"fail", "wait", "ok", "ok"},
+			states: []State{Open, Open, HalfOpen, Closed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Calls are counted over 10s, so that none are lost to a bucket rolling over during the test.
+			rule := strings.Replace(tt.rule, "{", fmt.Sprintf(`{"resource":"db","retryTimeoutMs":%d,"statIntervalMs":10000,"statSlidingWindowBucketCount":10,`, retryTimeout.Milliseconds()), 1)
+			b := newBreakers(t, "["+rule+"]")
+			var held func(bool)
+			for i, step := range tt.steps {
+				var done func(bool)
+				var err error
+				if step != "wait" && step != "release" {
+					done, err = b.Allow("db")
+					if refused := errors.Is(err, ErrOpen); refused != (step == "refused") {
+						t.Fatalf("step %d (%s): got %v", i, step, err)
+					}
+				}
+				switch step {
+				case "ok":
+					done(false)
+				case "fail":
+					done(true)
+				case "slow":
+					time.Sleep(20 * time.Millisecond)
+					done(false)
+				case "hold":
+					held = done
+				case "release":
+					held(false)
+				case "wait":
+					time.Sleep(retryTimeout + 10*time.Millisecond)
+				}
+				if got := b.State("db"); got != tt.states[i] {
+					t.Fatalf("step %d (%s): got state %v, want %v", i, step, got, tt.states[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateKeepsState(t *testing.T) {
+	rule := `{"resource":"db","strategy":2,"threshold":1,"minRequestAmount":1,"retryTimeoutMs":60000}`
+	b := newBreakers(t, "["+rule+"]")
+	done, _ := b.Allow("db")
+	done(true)
+	if err := b.Update(&pb.SentinelConfig{CircuitbreakerRulesJson: proto.String("[" + rule + "]")}); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.State("db"); got != Open {
+		t.Errorf("after an unchanged update: got %v, want %v", got, Open)
+	}
+	if err := b.Update(&pb.SentinelConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Allow("db"); err != nil {
+		t.Errorf("after the rule is removed: got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Failed reports whether a call failed because of its server, rather than its caller: calls with no error,
+// or a client-side code such as InvalidArgument or Canceled, don't count against a breaker.
+func Failed(err error) bool {
+	switch status.Code(err) {
+	case codes.Unknown, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	}
+	return false
+}
+
+// UnaryClientInterceptor sends calls through b, mapping each to a resource with resource, or by its full
+// method name if that is nil. Calls refused by an open breaker fail with codes.Unavailable.
+func UnaryClientInterceptor(b *Breakers, resource func(method string) string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		done, err := allow(b, resource, method)
+		if err != nil {
+			return err
+		}
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		done(Failed(err))
+		return err
+	}
+}
+
+// StreamClientInterceptor sends streams through b like UnaryClientInterceptor. A stream's outcome is
+// recorded when it ends: when its response arrives, if the server only sends one, and otherwise with the
+// error it ends with. A stream whose context is done first counts as failed only if its deadline passed.
+func StreamClientInterceptor(b *Breakers, resource func(method string) string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		done, err := allow(b, resource, method)
+		if err != nil {
+			return nil, err
+		}
+		cs, err := streamer(ctx, desc, cc, method, opts...)
+		if err != nil {
+			done(Failed(err))
+			return nil, err
+		}
+		s := &clientStream{ClientStream: cs, desc: desc, done: done, ended: make(chan struct{})}
+		go s.watch(ctx)
+		return s, nil
+	}
+}
+
+func allow(b *Breakers, resource func(string) string, method string) (func(bool), error) {
+	name := method
+	if resource != nil {
+		name = resource(method)
+	}
+	done, err := b.Allow(name)
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return done, nil
+}
+
+// clientStream records the outcome of a stream once it has ended.
+type clientStream struct {
+	grpc.ClientStream
+	desc  *grpc.StreamDesc
+	done  func(bool)
+	once  sync.Once
+	ended chan struct{}
+}
+
+func (s *clientStream) finish(failed bool) {
+	s.once.Do(func() {
+		s.done(failed)
+		close(s.ended)
+	})
+}
+
+// watch records the outcome of a stream whose caller gives up on it, by cancelling ctx, without seeing an error
+// or response, so that a half-open breaker isn't left waiting for its probe.
+func (s *clientStream) watch(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.finish(errors.Is(ctx.Err(), context.DeadlineExceeded))
+	case <-s.ended:
+	}
+}
+
+func (s *clientStream) SendMsg(m any) error {
+	err := s.ClientStream.SendMsg(m)
+	// io.EOF means the stream has ended, and its status is left for RecvMsg to return.
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.finish(Failed(err))
+	}
+	return err
+}
+
+func (s *clientStream) CloseSend() error {
+	err := s.ClientStream.CloseSend()
+	if err != nil {
+		s.finish(Failed(err))
+	}
+	return err
+}
+
+func (s *clientStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	switch {
+	case err != nil:
+		s.finish(!errors.Is(err, io.EOF) && Failed(err))
+	case !s.desc.ServerStreams:
+		// The one response has arrived, so the call has succeeded.
+		s.finish(false)
+	}
+	return err
+}
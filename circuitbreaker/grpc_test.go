@@ -0,0 +1,129 @@
+package circuitbreaker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+const uploadMethod = "/test.Upload/Upload"
+
+// uploadDesc is a client-streaming method, which replies once the client has closed its side of the stream,
+// and fails with codes.Unavailable if any message sent has the key "fail", or waits for the client to give up
+// if one has the key "hang".
+var uploadDesc = grpc.StreamDesc{
+	StreamName:    "Upload",
+	ClientStreams: true,
+	Handler: func(srv any, ss grpc.ServerStream) error {
+		var fail, hang bool
+		for {
+			var m pb.Tag
+			err := ss.RecvMsg(&m)
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			fail = fail || m.Key == "fail"
+			hang = hang || m.Key == "hang"
+		}
+		switch {
+		case fail:
+			return status.Error(codes.Unavailable, "upload failed")
+		case hang:
+			<-ss.Context().Done()
+			return ss.Context().Err()
+		}
+		return ss.SendMsg(&pb.Tag{Key: "done"})
+	},
+}
+
+// dialUpload starts an Upload server, and returns a connection to it which sends calls through b.
+func dialUpload(t *testing.T, b *Breakers) *grpc.ClientConn {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{ServiceName: "test.Upload", HandlerType: (*any)(nil), Streams: []grpc.StreamDesc{uploadDesc}}, struct{}{})
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial(lis.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStreamInterceptor(StreamClientInterceptor(b, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// upload makes a client-streaming call the way generated CloseAndRecv methods do.
+func upload(ctx context.Context, conn *grpc.ClientConn, key string) error {
+	cs, err := conn.NewStream(ctx, &uploadDesc, uploadMethod)
+	if err != nil {
+		return err
+	}
+	if err := cs.SendMsg(&pb.Tag{Key: key}); err != nil {
+		return err
+	}
+	if err := cs.CloseSend(); err != nil {
+		return err
+	}
+	return cs.RecvMsg(&pb.Tag{})
+}
+
+func TestClientStreamProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  string // key sent by the half-open probe
+		cancel bool   // give up on the probe
+		expect State  // after the probe
+	}{
+		{"probe succeeds", "ok", false, Closed},
+		{"probe fails", "fail", false, Open},
+		// Like a unary call, a cancelled stream is the caller's doing, so it doesn't count against the server.
+		{"probe cancelled", "hang", true, Closed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBreakers(t, `[{"resource":"`+uploadMethod+`","strategy":2,"threshold":1,"minRequestAmount":1,"retryTimeoutMs":50}]`)
+			conn := dialUpload(t, b)
+			if err := upload(context.Background(), conn, "fail"); status.Code(err) != codes.Unavailable {
+				t.Fatalf("failing call: got %v", err)
+			}
+			if got := b.State(uploadMethod); got != Open {
+				t.Fatalf("after a failed call: got %v, want %v", got, Open)
+			}
+			time.Sleep(60 * time.Millisecond)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			upload(ctx, conn, tt.probe)
+			cancel()
+			// The outcome of a cancelled probe may be recorded by the interceptor just after upload returns.
+			deadline := time.Now().Add(time.Second)
+			for b.State(uploadMethod) != tt.expect && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := b.State(uploadMethod); got != tt.expect {
+				t.Fatalf("after the probe: got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package circuitbreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Strategy is what a breaker counts as failure. The values are the same as in sentinel-golang.
+type Strategy int
+
+const (
+	SlowRequestRatio Strategy = iota // trip when the ratio of calls slower than MaxAllowedRtMs exceeds Threshold
+	ErrorRatio                       // trip when the ratio of failed calls exceeds Threshold
+	ErrorCount                       // trip when the number of failed calls reaches Threshold
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case SlowRequestRatio:
+		return "SlowRequestRatio"
+	case ErrorRatio:
+		return "ErrorRatio"
+	case ErrorCount:
+		return "ErrorCount"
+	}
+	return fmt.Sprintf("Strategy(%d)", int(s))
+}
+
+// Rule configures a circuit breaker for a resource, in sentinel-golang's JSON format.
+type Rule struct {
+	ID                           string   `json:"id,omitempty"`
+	Resource                     string   `json:"resource"`
+	Strategy                     Strategy `json:"strategy"`
+	RetryTimeoutMs               uint32   `json:"retryTimeoutMs"`   // how long the breaker stays open before probing
+	MinRequestAmount             uint64   `json:"minRequestAmount"` // calls needed in the interval before the breaker can trip
+	StatIntervalMs               uint32   `json:"statIntervalMs"`   // 1000 if unset
+	StatSlidingWindowBucketCount uint32   `json:"statSlidingWindowBucketCount"`
+	MaxAllowedRtMs               uint64   `json:"maxAllowedRtMs"` // for SlowRequestRatio
+	Threshold                    float64  `json:"threshold"`
+	ProbeNum                     uint64   `json:"probeNum"` // successful probes needed to close again; 1 if unset
+}
+
+func (r *Rule) interval() time.Duration {
+	if r.StatIntervalMs == 0 {
+		return time.Second
+	}
+	return time.Duration(r.StatIntervalMs) * time.Millisecond
+}
+
+// Parse decodes the circuit breaker rules of cfg, which may be nil.
+func Parse(cfg *pb.SentinelConfig) ([]Rule, error) {
+	var rules []Rule
+	if data := cfg.GetCircuitbreakerRulesJson(); data != "" {
+		if err := json.Unmarshal([]byte(data), &rules); err != nil {
+			return nil, fmt.Errorf("parsing circuit breaker rules: %w", err)
+		}
+	}
+	for _, r := range rules {
+		switch {
+		case r.Resource == "":
+			return nil, fmt.Errorf("circuit breaker rule %q has no resource", r.ID)
+		case r.Strategy < SlowRequestRatio || r.Strategy > ErrorCount:
+			return nil, fmt.Errorf("circuit breaker rule %q for %s has unknown strategy %d", r.ID, r.Resource, r.Strategy)
+		case r.Threshold < 0:
+			return nil, fmt.Errorf("circuit breaker rule %q for %s has a negative threshold", r.ID, r.Resource)
+		case r.Strategy != ErrorCount && r.Threshold > 1:
+			return nil, fmt.Errorf("circuit breaker rule %q for %s has a %s threshold over 1", r.ID, r.Resource, r.Strategy)
+		}
+	}
+	return rules, nil
+}
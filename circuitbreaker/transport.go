@@ -0,0 +1,44 @@
+package circuitbreaker
+
+import (
+	"net/http"
+)
+
+// Transport is an http.RoundTripper which sends requests through Breakers.
+// Response times are measured until the response headers arrive.
+type Transport struct {
+	// Base makes the requests. http.DefaultTransport if nil.
+	Base     http.RoundTripper
+	Breakers *Breakers
+	// Resource maps a request to its resource. The request's host if nil.
+	Resource func(*http.Request) string
+	// Failed reports whether a request failed. If nil, errors and 5xx responses fail.
+	Failed func(*http.Response, error) bool
+}
+
+// RoundTrip implements http.RoundTripper. Requests refused by an open breaker fail with an error wrapping ErrOpen.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resource := req.URL.Host
+	if t.Resource != nil {
+		resource = t.Resource(req)
+	}
+	done, err := t.Breakers.Allow(resource)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	res, err := base.RoundTrip(req)
+	if t.Failed != nil {
+		done(t.Failed(res, err))
+	} else {
+		done(err != nil || res.StatusCode >= 500)
+	}
+	return res, err
+}
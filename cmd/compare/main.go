@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/StanzaSystems/stream-demo/compare"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+	"github.com/StanzaSystems/stream-demo/scenario"
+	"github.com/StanzaSystems/stream-demo/streams"
+)
+
+var (
+	a_profile     string
+	a_hub         string
+	a_insecure    bool
+	a_apikey      hubclient.Secret
+	a_guard       string
+	a_environment string
+	b_profile     string
+	b_hub         string
+	b_insecure    bool
+	b_apikey      hubclient.Secret
+	b_guard       string
+	b_environment string
+	scenario_file string
+	trace_file    string
+	trace_format  string
+	tolerance     float64
+	limit         float64
+	only_diffs    bool
+)
+
+// Runs a scenario or a recorded trace against two targets at once and prints, for every step, how their
+// allocations differ. A target is a hub and a Guard, so two hubs or two Guards configured with different
+// policies can be compared. This repo has no allocator of its own, so an allocator running locally can only be
+// compared by running it behind a local hub. Exits non-zero if the targets disagreed.
+func main() {
+	flag.StringVar(&a_profile, "a_profile", "", "Profile to load target A's settings from. Defaults as for -profile in the other commands.")
+	flag.StringVar(&a_hub, "a_hub", "", "Hub address host:port of target A. Defaults to the profile's hub.")
+	flag.BoolVar(&a_insecure, "a_insecure", false, "Skip TLS validation for target A (for local development only).")
+	flag.Var(&a_apikey, "a_apikey", "Stanza API key for target A. Defaults to the profile's apikey.")
+	flag.StringVar(&a_guard, "a_guard", "", "Guard of target A. Defaults to the scenario's or trace's Guard.")
+	flag.StringVar(&a_environment, "a_environment", "", "Environment of target A. Defaults to the scenario's or trace's environment.")
+	flag.StringVar(&b_profile, "b_profile", "", "Profile to load target B's settings from. Defaults to -a_profile.")
+	flag.StringVar(&b_hub, "b_hub", "", "Hub address host:port of target B. Defaults to -a_hub.")
+	flag.BoolVar(&b_insecure, "b_insecure", false, "Skip TLS validation for target B (for local development only). Defaults to -a_insecure if B uses A's hub.")
+	flag.Var(&b_apikey, "b_apikey", "Stanza API key for target B. Defaults to -a_apikey.")
+	flag.StringVar(&b_guard, "b_guard", "", "Guard of target B. Defaults to the scenario's or trace's Guard.")
+	flag.StringVar(&b_environment, "b_environment", "", "Environment of target B. Defaults to the scenario's or trace's environment.")
+	flag.StringVar(&scenario_file, "scenario", "", "Scenario file to run. Defaults to the demo walkthrough unless -trace is given.")
+	flag.StringVar(&trace_file, "trace", "", "UpdateStreams recording to run instead of a scenario.")
+	flag.StringVar(&trace_format, "trace_format", streams.FormatNDJSON, "Format of the -trace file: ndjson or delimited.")
+	flag.Float64Var(&tolerance, "tolerance", 0.01, "Allowed difference between the targets' weights for a stream.")
+	flag.Float64Var(&limit, "limit", 0, "If set, report totals as utilization of this limit.")
+	flag.BoolVar(&only_diffs, "only_diffs", false, "Only print steps where the targets disagree.")
+	flag.Parse()
+
+	if scenario_file != "" && trace_file != "" {
+		log.Fatalf("use only one of -scenario and -trace")
+	}
+	if b_profile == "" {
+		b_profile = a_profile
+	}
+	if b_hub == "" {
+		b_hub = a_hub
+		if !isSet("b_insecure") {
+			b_insecure = a_insecure
+		}
+	}
+	if b_apikey == "" {
+		b_apikey = a_apikey
+	}
+
+	var steps []compare.Step
+	var guard, environment string
+	if trace_file != "" {
+		f, err := os.Open(trace_file)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		reader, err := streams.NewReader(f, trace_format)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		recs, err := reader.ReadAll()
+		f.Close()
+		if err != nil {
+			log.Fatalf("reading %s: %v", trace_file, err)
+		}
+		if len(recs) > 0 {
+			guard, environment = recs[0].Request.GetGuardName(), recs[0].Request.GetEnvironment()
+		}
+		steps = compare.FromRecords(recs)
+	} else {
+		sc, err := scenario.Default()
+		if scenario_file != "" {
+			sc, err = scenario.Load(scenario_file)
+		}
+		if err != nil {
+			log.Fatalf("could not load scenario: %v", err)
+		}
+		guard, environment = sc.GuardName, sc.Environment
+		steps = compare.FromScenario(sc)
+	}
+
+	targetA := &hubclient.Flags{Profile: a_profile, Hub: a_hub, Insecure: a_insecure, APIKey: a_apikey, Guard: or(a_guard, guard), Environment: or(a_environment, environment)}
+	targetB := &hubclient.Flags{Profile: b_profile, Hub: b_hub, Insecure: b_insecure, APIKey: b_apikey, Guard: or(b_guard, guard), Environment: or(b_environment, environment)}
+	resolve("A", targetA)
+	resolve("B", targetB)
+	if targetA.Hub == targetB.Hub && targetA.Guard == targetB.Guard && targetA.Environment == targetB.Environment {
+		// Both targets would update the same streams on the same Guard, so they could only ever agree.
+		log.Fatalf("targets A and B are both %q in %q on %s: give B a different -b_hub, -b_guard or -b_environment",
+			targetA.Guard, targetA.Environment, targetA.Hub)
+	}
+	a, b := dial(targetA), dial(targetB)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("A: %q in %q, %v\nB: %q in %q, %v\n\n", targetA.Guard, targetA.Environment, targetA, targetB.Guard, targetB.Environment, targetB)
+	sum, err := compare.Run(ctx, a, b, steps, compare.Options{
+		Tolerance: float32(tolerance),
+		Limit:     float32(limit),
+		OnlyDiffs: only_diffs,
+	}, os.Stdout)
+	sum.Write(os.Stdout)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if sum.Disagreed() {
+		os.Exit(1)
+	}
+}
+
+func resolve(name string, target *hubclient.Flags) {
+	if err := target.Resolve(); err != nil {
+		log.Fatalf("target %s: %v", name, err)
+	}
+}
+
+func dial(target *hubclient.Flags) *streams.Client {
+	conn, err := target.Dial()
+	if err != nil {
+		log.Fatalf("did not connect to %s: %v", target.Hub, err)
+	}
+	return streams.NewClient(conn, target.APIKey.Reveal(), target.Guard, target.Environment)
+}
+
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func or(s, def string) string {
+	if s != "" {
+		return s
+	}
+	return def
+}
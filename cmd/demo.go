@@ -2,236 +2,147 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
-	"go.openly.dev/pointy"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+	"github.com/StanzaSystems/stream-demo/output"
+	"github.com/StanzaSystems/stream-demo/repl"
+	"github.com/StanzaSystems/stream-demo/scenario"
+	"github.com/StanzaSystems/stream-demo/streams"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/encoding/prototext"
 )
 
 var (
-	hub          string
-	verbose      bool
-	hub_insecure bool
+	hub           hubclient.Flags
+	verbose       bool
+	scenario_file string
+	interactive   bool
+	output_format string
+	record_file   string
+	record_format string
 )
 
-const apikey = "sb-demo-apikey"
-
-// Tests against a demo Guard with a overall limit of 50 and a per-customer-id limit of 15.
+// Runs a scenario against a Stream Balancer Guard. The default scenario tests against a demo Guard
+// with a overall limit of 50 and a per-customer-id limit of 15. The Guard and environment come from -guard,
+// -environment, $STANZA_ENVIRONMENT or a profile as in the other commands, or else from the scenario, which
+// also overrides the built-in demo profile's.
 func main() {
-	flag.StringVar(&hub, "hub", "hub.dev.getstanza.dev:9020", "The hub address host:port to issue queries against.")
-	//flag.StringVar(&hub, "hub", "hub.demo.getstanza.io:9020", "The hub address host:port to issue queries against.") // TODO: when deployed to demo.
-	flag.BoolVar(&hub_insecure, "hub_insecure", false, "Skip Hub TLS validation (for local development only).")
+	hub.Register(flag.CommandLine)
+	hub.RegisterGuard(flag.CommandLine)
 	flag.BoolVar(&verbose, "verbose", false, "Print out details on every success/failure.")
+	flag.StringVar(&scenario_file, "scenario", "", "Path to a JSON scenario file to run instead of the default walkthrough.")
+	flag.BoolVar(&interactive, "interactive", false, "Explore the scenario's Guard interactively instead of running the scenario steps.")
+	flag.StringVar(&output_format, "output", "table", "Output format: table, json or ndjson.")
+	flag.StringVar(&record_file, "record", "", "Record every UpdateStreams call to this file, for use with cmd/replay.")
+	flag.StringVar(&record_format, "record_format", streams.FormatNDJSON, "Format of the -record file: ndjson or delimited.")
 	flag.Parse()
 
-	config := &tls.Config{} // use default system CA
-	creds := credentials.NewTLS(config)
-	if hub_insecure {
-		creds = insecure.NewCredentials()
-	}
-	conn, err := grpc.Dial(hub, grpc.WithTransportCredentials(creds))
+	printer, err := output.New(output_format, os.Stdout)
 	if err != nil {
-		log.Fatalf("did not connect: %v", err)
+		log.Fatalf("%v", err)
 	}
-	defer conn.Close()
-	client := pb.NewStreamBalancerServiceClient(conn)
-
-	fmt.Printf(
-		`
-Welcome to the Stanza Stream Balancer demo. This feature is currently in experimental/evaluation mode (see README.md in this repo for more information).
-This demo runs a series of requests against Stanza's control plane to demonstrate how it can balance stream operations.
-The demo config in use is as follows:
- * There is an overall limit of 50 units of capacity in the system
- * Each distinct customer is allocated up to 15 units of capacity
- * If the overall system is at capacity, then capacity is shared fairly
 
-`)
-
-	// First, forget any existing streams created by previous runs of this demo
-	fmt.Printf("Start demo by clearing up any streams left over from previous runs.\n")
-
-	_, err = sendReq(nil, []string{"a-new-stream", "another-new-stream", "yet-another-new-stream", "cust-3-stream", "cust-4-stream", "cust-1-streamp0", "cust-1-streamp1", "cust-1-streamp2"}, client)
+	sc, err := scenario.Default()
+	if scenario_file != "" {
+		sc, err = scenario.Load(scenario_file)
+	}
 	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
-		os.Exit(1)
+		log.Fatalf("could not load scenario: %v", err)
 	}
 
-	// Request one stream - should get full per-customer 15 weight
-	reqs := []*pb.StreamRequest{
-		{
-			StreamId:  "a-new-stream",
-			MinWeight: 1,
-			MaxWeight: 20,
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer1",
-				}},
-		},
+	if err := hub.Resolve(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	hub.Default(sc.GuardName, sc.Environment)
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Using %v\n", &hub)
 	}
 
-	fmt.Printf("First, we request one stream. We expect Stanza to permit 15 units of capacity for this stream, using the customer's allocated capacity.\n")
-	_, err = sendReq(reqs, nil, client)
-
+	conn, err := hub.Dial()
 	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
-		os.Exit(1)
+		log.Fatalf("did not connect: %v", err)
 	}
+	defer conn.Close()
 
-	// try allocate another stream to same customer - will split the 15 quota between them
-	reqs = []*pb.StreamRequest{
-		{
-			StreamId:  "another-new-stream",
-			MinWeight: 1,
-			MaxWeight: 20,
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer1",
-				}},
-		},
+	var opts []streams.Option
+	var recorder *streams.Recorder
+	if record_file != "" {
+		f, err := os.Create(record_file)
+		if err != nil {
+			log.Fatalf("could not create recording: %v", err)
+		}
+		defer f.Close()
+		recorder, err = streams.NewRecorder(f, record_format)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		opts = append(opts, streams.WithRecorder(recorder))
 	}
-	fmt.Printf("Now, we request a second stream for the same customer. It should split the customer's quota between the two streams, so the existing stream is downsized.\n")
-	_, err = sendReq(reqs, nil, client)
-
-	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
-		os.Exit(1)
+	client := streams.NewClient(conn, hub.APIKey.Reveal(), hub.Guard, hub.Environment, opts...)
+
+	if interactive {
+		session := repl.New(func(narration string, reqs []*pb.StreamRequest, rms []string) (*pb.UpdateStreamsResponse, error) {
+			return sendReq(narration, reqs, rms, client, printer)
+		}, os.Stdout)
+		if err := session.Run(os.Stdin); err != nil {
+			log.Fatalf("reading commands: %v", err)
+		}
+		if recorder != nil && recorder.Err() != nil {
+			log.Printf("recording to %s failed: %v", record_file, recorder.Err())
+		}
+		return
 	}
 
-	// try allocate another stream to a new customer - will give 15 again
-	reqs = []*pb.StreamRequest{
-		{
-			StreamId:  "yet-another-new-stream",
-			MinWeight: 1,
-			MaxWeight: 20,
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer2",
-				}},
-		},
+	// Commentary and expectation failures would corrupt machine readable output, so only tables get them on stdout.
+	commentary := os.Stdout
+	if output_format != "table" {
+		commentary = os.Stderr
 	}
-	fmt.Printf("Attempt to allocate another stream for a different customer. It should be allocated 15 units of capacity.\n")
-	_, err = sendReq(reqs, nil, client)
 
-	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
-		os.Exit(1)
+	fmt.Fprintf(commentary, "\n%s\n", sc.Intro)
+	failed := 0
+	for i, step := range sc.Steps {
+		fmt.Fprintf(commentary, "%s\n", step.Narration)
+		res, err := sendReq(step.Narration, step.Add, step.End, client, printer)
+		if err != nil {
+			fmt.Printf("Got error from stanza: %+v\n", err)
+			os.Exit(1)
+		}
+		if mismatches := step.Check(res, sc.Tolerance); len(mismatches) > 0 {
+			failed++
+			fmt.Fprintf(commentary, "Step %d: %d allocation(s) did not match expectations:\n", i, len(mismatches))
+			scenario.WriteDiff(commentary, mismatches)
+			fmt.Fprintf(commentary, "\n")
+		}
+		time.Sleep(step.Pause)
 	}
-
-	// add more streams for 2 further customers and hit the overall limit of 50 - every customer limited to 12.5 total
-	reqs = []*pb.StreamRequest{
-		{
-			StreamId:  "cust-3-stream",
-			MinWeight: 1,
-			MaxWeight: 20,
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer3",
-				}},
-		},
-		{
-			StreamId:  "cust-4-stream",
-			MinWeight: 1,
-			MaxWeight: 20,
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer4",
-				}},
-		},
+	if recorder != nil && recorder.Err() != nil {
+		log.Printf("recording to %s failed: %v", record_file, recorder.Err())
 	}
-
-	fmt.Printf("Two more customers request streams. The system now has more requests than capacity, so some existing streams are downsized.\n")
-	_, err = sendReq(reqs, nil, client)
-
-	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
+	if failed > 0 {
+		fmt.Fprintf(commentary, "%d of %d steps did not match expected allocations.\n", failed, len(sc.Steps))
 		os.Exit(1)
 	}
+}
 
-	// remove some streams and see some remaining streams upsized
-	fmt.Printf("Removing some existing streams leaves more capacity for the rest, so they are upsized - removing \"another-new-stream\" and \"cust-3-stream\"\n")
-	_, err = sendReq(nil, []string{"another-new-stream", "cust-3-stream"}, client)
-	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
-		os.Exit(1)
+func sendReq(narration string, reqs []*pb.StreamRequest, rms []string, client *streams.Client, printer output.Printer) (*pb.UpdateStreamsResponse, error) {
+	req := client.Request(reqs, rms)
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Request: \n%s\n", prototext.Format(req))
 	}
-
-	// overload the quota for customer1 requests - it will prioritise the highest priority requests
-	reqs = []*pb.StreamRequest{
-		{
-			StreamId:      "cust-1-streamp0",
-			MinWeight:     5,
-			MaxWeight:     20,
-			PriorityBoost: pointy.Int32(5),
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer1",
-				}},
-		},
-		{
-			StreamId:      "cust-1-streamp1",
-			MinWeight:     5,
-			MaxWeight:     20,
-			PriorityBoost: pointy.Int32(4),
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer1",
-				}},
-		},
-		// won't get allocated because we can't allocate its minweight in addition to the current p5 stream
-		// a-new-stream plus the above two higher priority streams
-		// we don't currently preempt running streams, although we could add that as an option
-		{
-			StreamId:      "cust-1-streamp2",
-			MinWeight:     5,
-			MaxWeight:     20,
-			PriorityBoost: pointy.Int32(3),
-			Tags: []*pb.Tag{
-				{
-					Key:   "customer_id",
-					Value: "customer1",
-				}},
-		},
+	res, err := client.Send(context.Background(), req)
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Result: \n%s\n\n", prototext.Format(res))
 	}
-
-	fmt.Printf("Finally, we request too many streams for customer1 - we cannot serve the minimum requested stream size for each stream. Stanza serves the two higher priority streams in this request, and continues to serve the existing stream a-new-stream.\n")
-
-	_, err = sendReq(reqs, nil, client)
 	if err != nil {
-		fmt.Printf("Got error from stanza: %+v\n", err)
-		os.Exit(1)
-	}
-}
-
-func sendReq(reqs []*pb.StreamRequest, rms []string, client pb.StreamBalancerServiceClient) (*pb.UpdateStreamsResponse, error) {
-	ctx := context.Background()
-	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", apikey)
-
-	req := pb.UpdateStreamsRequest{
-		GuardName:   "Stream Balancer Quota",
-		Environment: "sb_quota",
-		Requests:    reqs,
-		Ended:       rms,
+		return nil, err
 	}
-	fmt.Printf("Request: \n%s\n", prototext.Format(&req))
-
-	res, err := client.UpdateStreams(ctx, &req)
-	fmt.Printf("Result: \n%s\n\n", prototext.Format(res))
-	return res, err
+	printer.Print(narration, req, res)
+	return res, nil
 }
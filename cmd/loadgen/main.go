@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/StanzaSystems/stream-demo/hubclient"
+	"github.com/StanzaSystems/stream-demo/loadgen"
+	"github.com/StanzaSystems/stream-demo/streams"
+)
+
+var (
+	hub hubclient.Flags
+
+	customers       int
+	duration        time.Duration
+	tick            time.Duration
+	arrival         string
+	rate            float64
+	burst           int
+	stream_dist     string
+	stream_duration time.Duration
+	min_weight      float64
+	max_weight      float64
+	priorities      string
+	tags            string
+	limit           float64
+	seed            int64
+	record_file     string
+	record_format   string
+)
+
+// Simulates customers opening and closing streams against a Stream Balancer Guard, then reports
+// throughput, latency, denials, utilization and fairness. Interrupt to stop early; streams are always ended.
+func main() {
+	hub.Register(flag.CommandLine)
+	hub.RegisterGuard(flag.CommandLine)
+
+	flag.IntVar(&customers, "customers", 5, "Number of distinct customers opening streams.")
+	flag.DurationVar(&duration, "duration", time.Minute, "How long to generate load for.")
+	flag.DurationVar(&tick, "tick", 100*time.Millisecond, "Arrivals and departures within a tick are sent in one UpdateStreams call.")
+	flag.StringVar(&arrival, "arrival", "poisson", "Arrival process: poisson, uniform or bursty.")
+	flag.Float64Var(&rate, "rate", 2, "Mean number of new streams per second, across all customers.")
+	flag.IntVar(&burst, "burst", 5, "Number of streams opened together by the bursty arrival process.")
+	flag.StringVar(&stream_dist, "stream_dist", "exponential", "Stream duration distribution: fixed, exponential or uniform.")
+	flag.DurationVar(&stream_duration, "stream_duration", 10*time.Second, "Mean stream duration.")
+	flag.Float64Var(&min_weight, "min_weight", 1, "MinWeight of every stream.")
+	flag.Float64Var(&max_weight, "max_weight", 20, "MaxWeight of every stream.")
+	flag.StringVar(&priorities, "priorities", "", "Priority boost mix as boost:weight pairs, e.g. \"0:8,5:2\".")
+	flag.StringVar(&tags, "tags", "", "Tag mix as key=value:weight entries, e.g. \"tier=free:3,tier=paid:1\". customer_id is always set.")
+	flag.Float64Var(&limit, "limit", 50, "The Guard's overall limit, used to report utilization.")
+	flag.Int64Var(&seed, "seed", time.Now().UnixNano(), "Random seed, for repeatable runs.")
+	flag.StringVar(&record_file, "record", "", "Record every UpdateStreams call to this file, for use with cmd/replay.")
+	flag.StringVar(&record_format, "record_format", streams.FormatNDJSON, "Format of the -record file: ndjson or delimited.")
+	flag.Parse()
+
+	arr, err := loadgen.NewArrival(arrival, rate, burst)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	dist, err := loadgen.NewDistribution(stream_dist, stream_duration)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	prio, err := loadgen.ParsePriorityMix(priorities)
+	if err != nil {
+		log.Fatalf("bad -priorities: %v", err)
+	}
+	tagMix, err := loadgen.ParseTagMix(tags)
+	if err != nil {
+		log.Fatalf("bad -tags: %v", err)
+	}
+
+	if err := hub.Resolve(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	conn, err := hub.Dial()
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer conn.Close()
+
+	var opts []streams.Option
+	var recorder *streams.Recorder
+	if record_file != "" {
+		f, err := os.Create(record_file)
+		if err != nil {
+			log.Fatalf("could not create recording: %v", err)
+		}
+		defer f.Close()
+		recorder, err = streams.NewRecorder(f, record_format)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		opts = append(opts, streams.WithRecorder(recorder))
+	}
+	client := streams.NewClient(conn, hub.APIKey.Reveal(), hub.Guard, hub.Environment, opts...)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Generating load against %q in %q for %v (seed %d) using %v...\n", hub.Guard, hub.Environment, duration, seed, &hub)
+	report, err := loadgen.Run(ctx, client, loadgen.Config{
+		Customers:      customers,
+		Duration:       duration,
+		Tick:           tick,
+		Arrival:        arr,
+		StreamDuration: dist,
+		MinWeight:      float32(min_weight),
+		MaxWeight:      float32(max_weight),
+		Priorities:     prio,
+		Tags:           tagMix,
+		Limit:          float32(limit),
+		Seed:           seed,
+	})
+	if report != nil {
+		report.Write(os.Stdout)
+	}
+	if recorder != nil && recorder.Err() != nil {
+		log.Printf("recording to %s failed: %v", record_file, recorder.Err())
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/StanzaSystems/stream-demo/hubclient"
+	"github.com/StanzaSystems/stream-demo/replay"
+	"github.com/StanzaSystems/stream-demo/streams"
+)
+
+var (
+	hub         hubclient.Flags
+	guard       string
+	environment string
+
+	format    string
+	speed     float64
+	tolerance float64
+)
+
+// Re-issues UpdateStreams traffic recorded with -record against a hub, and reports where the
+// new allocations diverge from the recorded ones. Exits non-zero if anything diverged.
+func main() {
+	hub.Register(flag.CommandLine)
+	flag.StringVar(&guard, "guard", "", "Replay against this Guard instead of the recorded one.")
+	flag.StringVar(&environment, "environment", "", "Replay against this environment instead of the recorded one.")
+	flag.StringVar(&format, "format", streams.FormatNDJSON, "Format of the recording: ndjson or delimited.")
+	flag.Float64Var(&speed, "speed", 1, "Replay speed: 1 keeps the recorded timing, 2 is twice as fast, 0 is as fast as possible.")
+	flag.Float64Var(&tolerance, "tolerance", 0.01, "Allowed difference between recorded and replayed weights.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <recording>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	reader, err := streams.NewReader(f, format)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	recs, err := reader.ReadAll()
+	f.Close()
+	if err != nil {
+		log.Fatalf("reading %s: %v", flag.Arg(0), err)
+	}
+
+	if err := hub.Resolve(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	conn, err := hub.Dial()
+	if err != nil {
+		log.Fatalf("did not connect: %v", err)
+	}
+	defer conn.Close()
+	client := streams.NewClient(conn, hub.APIKey.Reveal(), guard, environment)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Replaying %d calls using %v...\n\n", len(recs), &hub)
+	sum, err := replay.Run(ctx, client, recs, replay.Options{
+		Speed:       speed,
+		Tolerance:   float32(tolerance),
+		GuardName:   guard,
+		Environment: environment,
+	}, os.Stdout)
+	sum.Write(os.Stdout)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if sum.Diverged() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func authToken(fs *flag.FlagSet) runFunc {
+	environment := fs.String("environment", "", "The environment the bearer token is for. Defaults to the profile's environment.")
+	reveal := fs.Bool("reveal", false, "Print the bearer token itself rather than redacting it.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		*environment = or(*environment, hub.Environment)
+		if err := required(map[string]string{"environment": *environment}); err != nil {
+			return nil, err
+		}
+		res, err := pb.NewAuthServiceClient(conn).GetBearerToken(ctx, &pb.GetBearerTokenRequest{Environment: *environment})
+		if err != nil || *reveal {
+			return res, err
+		}
+		res.BearerToken = hubclient.Redact(res.GetBearerToken())
+		return res, nil
+	}
+}
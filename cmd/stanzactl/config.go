@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func configGuard(fs *flag.FlagSet) runFunc {
+	g := newGuardFlags(fs, false)
+	service := fs.String("service", "", "The name of the service loading the Guard.")
+	release := fs.String("release", "", "The release of the service loading the Guard.")
+	versionSeen := fs.String("version_seen", "", "Only return the config if it is newer than this version.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		if err := g.resolve(hub); err != nil {
+			return nil, err
+		}
+		req := &pb.GetGuardConfigRequest{
+			Selector: &pb.GuardServiceSelector{
+				Environment:    g.environment,
+				GuardName:      g.guard,
+				ServiceName:    *service,
+				ServiceRelease: *release,
+				Tags:           g.tags,
+			},
+		}
+		if isSet(fs, "version_seen") {
+			req.VersionSeen = versionSeen
+		}
+		return pb.NewConfigServiceClient(conn).GetGuardConfig(ctx, req)
+	}
+}
+
+func configService(fs *flag.FlagSet) runFunc {
+	var tags tagsFlag
+	service := fs.String("service", "", "The service name.")
+	environment := fs.String("environment", "", "The environment of the service. Defaults to the profile's environment.")
+	release := fs.String("release", "", "The release of the service.")
+	clientID := fs.String("client_id", "", "Client ID, as sent with quota requests.")
+	versionSeen := fs.String("version_seen", "", "Only return the config if it is newer than this version.")
+	fs.Var(&tags, "tags", "Tags as key=value pairs.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		*environment = or(*environment, hub.Environment)
+		if err := required(map[string]string{"service": *service, "environment": *environment}); err != nil {
+			return nil, err
+		}
+		req := &pb.GetServiceConfigRequest{
+			VersionSeen: *versionSeen,
+			Service: &pb.ServiceSelector{
+				Environment: *environment,
+				Name:        *service,
+				Tags:        tags,
+			},
+		}
+		if isSet(fs, "release") {
+			req.Service.Release = release
+		}
+		if isSet(fs, "client_id") {
+			req.ClientId = clientID
+		}
+		return pb.NewConfigServiceClient(conn).GetServiceConfig(ctx, req)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func healthGuard(fs *flag.FlagSet) runFunc {
+	g := newGuardFlags(fs, true)
+	boost := fs.Int("priority_boost", 0, "Priority boost relative to the feature's priority.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		if err := g.resolve(hub); err != nil {
+			return nil, err
+		}
+		req := &pb.QueryGuardHealthRequest{Selector: g.featureSelector()}
+		if isSet(fs, "priority_boost") {
+			req.PriorityBoost = proto.Int32(int32(*boost))
+		}
+		return pb.NewHealthServiceClient(conn).QueryGuardHealth(ctx, req)
+	}
+}
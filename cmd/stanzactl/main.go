@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/StanzaSystems/stream-demo/hubclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// command is a single stanzactl subcommand such as "token get".
+type command struct {
+	summary string
+	// flags registers the command's own flags and returns a function which builds and issues the call.
+	flags func(fs *flag.FlagSet) runFunc
+}
+
+// runFunc issues a command's call once its flags have been parsed and the connection settings resolved.
+// Commands default their Guard and environment to the ones in hub.
+type runFunc func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error)
+
+var commands = map[string]command{
+	"token get":      {"Request a single quota token with GetToken.", tokenGet},
+	"token validate": {"Validate ingress tokens with ValidateToken.", tokenValidate},
+	"lease get":      {"Request a batch of token leases with GetTokenLease.", leaseGet},
+	"lease consume":  {"Mark leased tokens as consumed with SetTokenLeaseConsumed.", leaseConsume},
+	"config guard":   {"Fetch a Guard's configuration with GetGuardConfig.", configGuard},
+	"config service": {"Fetch a service's configuration with GetServiceConfig.", configService},
+	"health guard":   {"Query a Guard's health with QueryGuardHealth.", healthGuard},
+	"usage query":    {"Query usage timeseries with GetUsage.", usageQuery},
+	"auth token":     {"Exchange the API key for a bearer token with GetBearerToken.", authToken},
+}
+
+// Exercises the Stanza hub APIs from the command line:
+//
+//	stanzactl <group> <command> [flags] [args]
+//
+// Run stanzactl with no arguments for the list of commands, or add -h to a command for its flags.
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+		os.Exit(2)
+	}
+	if os.Args[1] == "profile" {
+		profileCommand(os.Args[2], os.Args[3:])
+		return
+	}
+	name := os.Args[1] + " " + os.Args[2]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet("stanzactl "+name, flag.ExitOnError)
+	c := &call{}
+	c.conn.Register(fs)
+	fs.StringVar(&c.output, "output", "table", "Output format: table or json.")
+	fs.DurationVar(&c.timeout, "timeout", 10*time.Second, "Deadline for the call.")
+	run := cmd.flags(fs)
+	fs.Parse(os.Args[3:])
+
+	if err := c.run(run); err != nil {
+		fmt.Fprintf(os.Stderr, "stanzactl %s: %v\n", name, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: stanzactl <group> <command> [flags] [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "  %-16s %s\n", "profile list", "List the profiles in the profiles file.")
+	fmt.Fprintf(os.Stderr, "  %-16s %s\n", "profile show", "Show the resolved connection settings, with the API key redacted.")
+}
+
+// call holds the settings shared by every command.
+type call struct {
+	conn    hubclient.Flags
+	output  string
+	timeout time.Duration
+}
+
+func (c *call) run(run runFunc) error {
+	if c.output != "table" && c.output != "json" {
+		return fmt.Errorf("unknown output format %q, must be table or json", c.output)
+	}
+	if err := c.conn.Resolve(); err != nil {
+		return err
+	}
+	conn, err := c.conn.Dial()
+	if err != nil {
+		return fmt.Errorf("did not connect: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	res, err := run(c.conn.Context(ctx), conn, &c.conn)
+	if err != nil {
+		return err
+	}
+	return printMessage(os.Stdout, c.output, res)
+}
+
+// isSet reports whether the named flag was given on the command line, to tell
+// unset optional fields apart from zero values.
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// args returns the positional arguments, or an error naming what was expected if there are none.
+func args(fs *flag.FlagSet, what string) ([]string, error) {
+	if fs.NArg() == 0 {
+		return nil, fmt.Errorf("expected one or more %s as arguments", what)
+	}
+	return fs.Args(), nil
+}
+
+func required(values map[string]string) error {
+	var missing []string
+	for name, v := range values {
+		if v == "" {
+			missing = append(missing, "-"+name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("%s required", strings.Join(missing, " and "))
+}
+
+// or returns s, or def if s is empty.
+func or(s, def string) string {
+	if s != "" {
+		return s
+	}
+	return def
+}
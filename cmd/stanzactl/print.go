@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// printMessage writes res in the given output format. Responses with repeated results are
+// printed as tables with a row per result; anything else is printed as a field per line.
+func printMessage(w io.Writer, format string, res proto.Message) error {
+	if format == "json" {
+		b, err := protojson.MarshalOptions{Multiline: true, Indent: "  ", UseProtoNames: true}.Marshal(res)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	switch res := res.(type) {
+	case *pb.GetTokenLeaseResponse:
+		writeLeases(tw, res)
+	case *pb.ValidateTokenResponse:
+		fmt.Fprintf(tw, "TOKEN\tVALID\n")
+		for _, t := range res.GetTokensValid() {
+			fmt.Fprintf(tw, "%s\t%v\n", t.GetToken(), t.GetValid())
+		}
+	case *pb.GetUsageResponse:
+		writeUsage(tw, res)
+	default:
+		if n := writeFields(tw, "", res.ProtoReflect()); n == 0 {
+			fmt.Fprintf(tw, "OK\n")
+		}
+	}
+	return tw.Flush()
+}
+
+func writeLeases(w io.Writer, res *pb.GetTokenLeaseResponse) {
+	fmt.Fprintf(w, "granted\t%v\n\n", res.GetGranted())
+	if len(res.GetLeases()) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "TOKEN\tFEATURE\tBOOST\tWEIGHT\tREASON\tMODE\tEXPIRES\n")
+	for _, l := range res.GetLeases() {
+		expires := fmt.Sprintf("in %v", time.Duration(l.GetDurationMsec())*time.Millisecond)
+		if l.ExpiresAt != nil {
+			expires = formatTime(l.GetExpiresAt())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%g\t%s\t%s\t%s\n", l.GetToken(), orDash(l.GetFeature()), l.GetPriorityBoost(), l.GetWeight(), l.GetReason(), l.GetMode(), expires)
+	}
+}
+
+func writeUsage(w io.Writer, res *pb.GetUsageResponse) {
+	fmt.Fprintf(w, "GUARD\tFEATURE\tSERVICE\tPRIORITY\tTAGS\tSTART\tGRANTED\tWEIGHT\tNOT GRANTED\tWEIGHT\n")
+	for _, ts := range res.GetResult() {
+		priority := "-"
+		if ts.Priority != nil {
+			priority = fmt.Sprint(ts.GetPriority())
+		}
+		var tags []string
+		for _, t := range ts.GetTags() {
+			tags = append(tags, t.GetKey()+"="+t.GetValue())
+		}
+		for _, d := range ts.GetData() {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%g\t%d\t%g\n",
+				orDash(ts.GetGuard()), orDash(ts.GetFeature()), orDash(ts.GetService()), priority, orDash(strings.Join(tags, ",")),
+				formatTime(d.GetStartTs()), d.GetGranted(), d.GetGrantedWeight(), d.GetNotGranted(), d.GetNotGrantedWeight())
+		}
+	}
+}
+
+// writeFields writes every populated field of m as a name and value, flattening nested
+// messages into dotted names, and returns the number of fields written.
+func writeFields(w io.Writer, prefix string, m protoreflect.Message) int {
+	if ts, ok := m.Interface().(*timestamppb.Timestamp); ok {
+		fmt.Fprintf(w, "%s\t%s\n", strings.TrimSuffix(prefix, "."), formatTime(ts))
+		return 1
+	}
+	n := 0
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !m.Has(fd) {
+			continue
+		}
+		v, name := m.Get(fd), prefix+string(fd.Name())
+		switch {
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				n += writeValue(w, fmt.Sprintf("%s[%d]", name, i), fd, v.List().Get(i))
+			}
+		case fd.IsMap():
+			v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				n += writeValue(w, fmt.Sprintf("%s[%v]", name, k), fd.MapValue(), v)
+				return true
+			})
+		default:
+			n += writeValue(w, name, fd, v)
+		}
+	}
+	return n
+}
+
+func writeValue(w io.Writer, name string, fd protoreflect.FieldDescriptor, v protoreflect.Value) int {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return writeFields(w, name+".", v.Message())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			fmt.Fprintf(w, "%s\t%s\n", name, ev.Name())
+			return 1
+		}
+	}
+	fmt.Fprintf(w, "%s\t%v\n", name, v.Interface())
+	return 1
+}
+
+func formatTime(ts *timestamppb.Timestamp) string {
+	if ts == nil {
+		return "-"
+	}
+	return ts.AsTime().Local().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
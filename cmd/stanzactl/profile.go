@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/StanzaSystems/stream-demo/hubclient"
+)
+
+// profileCommand runs the profile commands, which only read local settings and so never dial the hub.
+func profileCommand(name string, args []string) {
+	fs := flag.NewFlagSet("stanzactl profile "+name, flag.ExitOnError)
+	var hub hubclient.Flags
+	hub.Register(fs)
+	hub.RegisterGuard(fs)
+	fs.Parse(args)
+
+	path := hubclient.DefaultConfigPath()
+	cfg, err := hubclient.LoadConfig(path)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "stanzactl profile %s: %v\n", name, err)
+		os.Exit(1)
+	}
+
+	switch name {
+	case "list":
+		fmt.Printf("Profiles file: %s\n\n", path)
+		def, _, _ := cfg.Select("")
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "NAME\tHUB\tINSECURE\tAPIKEY\tGUARD\tENVIRONMENT\n")
+		for _, n := range cfg.Names() {
+			_, p, _ := cfg.Select(n)
+			if n == def {
+				n += " (default)"
+			}
+			key := "-"
+			if p.APIKey != nil {
+				key = p.APIKey.String()
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\t%s\n", n, orDash(p.Hub), p.Insecure, key, orDash(p.Guard), orDash(p.Environment))
+		}
+		tw.Flush()
+	case "show":
+		if err := hub.ResolveWith(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "stanzactl profile show: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%v\nguard %q, environment %q\n", &hub, hub.Guard, hub.Environment)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command \"profile %s\"\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func tokenGet(fs *flag.FlagSet) runFunc {
+	g := newGuardFlags(fs, true)
+	clientID := fs.String("client_id", "", "Client ID used to track per-client token usage.")
+	boost := fs.Int("priority_boost", 0, "Priority boost relative to the feature's priority.")
+	weight := fs.Float64("weight", 1, "Weight of the request.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		if err := g.resolve(hub); err != nil {
+			return nil, err
+		}
+		req := &pb.GetTokenRequest{Selector: g.featureSelector()}
+		if isSet(fs, "client_id") {
+			req.ClientId = clientID
+		}
+		if isSet(fs, "priority_boost") {
+			req.PriorityBoost = proto.Int32(int32(*boost))
+		}
+		if isSet(fs, "weight") {
+			req.Weight = proto.Float32(float32(*weight))
+		}
+		return pb.NewQuotaServiceClient(conn).GetToken(ctx, req)
+	}
+}
+
+func tokenValidate(fs *flag.FlagSet) runFunc {
+	g := newGuardFlags(fs, false)
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		if err := g.resolve(hub); err != nil {
+			return nil, err
+		}
+		tokens, err := args(fs, "tokens")
+		if err != nil {
+			return nil, err
+		}
+		req := &pb.ValidateTokenRequest{}
+		for _, t := range tokens {
+			req.Tokens = append(req.Tokens, &pb.TokenInfo{Token: t, Guard: g.guardSelector()})
+		}
+		return pb.NewQuotaServiceClient(conn).ValidateToken(ctx, req)
+	}
+}
+
+func leaseGet(fs *flag.FlagSet) runFunc {
+	g := newGuardFlags(fs, true)
+	clientID := fs.String("client_id", "", "Client ID used to size batches of leases.")
+	boost := fs.Int("priority_boost", 0, "Priority boost relative to the feature's priority.")
+	weight := fs.Float64("default_weight", 1, "Weight to assume for each leased request.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		if err := g.resolve(hub); err != nil {
+			return nil, err
+		}
+		req := &pb.GetTokenLeaseRequest{Selector: g.featureSelector()}
+		if isSet(fs, "client_id") {
+			req.ClientId = clientID
+		}
+		if isSet(fs, "priority_boost") {
+			req.PriorityBoost = proto.Int32(int32(*boost))
+		}
+		if isSet(fs, "default_weight") {
+			req.DefaultWeight = proto.Float32(float32(*weight))
+		}
+		return pb.NewQuotaServiceClient(conn).GetTokenLease(ctx, req)
+	}
+}
+
+func leaseConsume(fs *flag.FlagSet) runFunc {
+	environment := fs.String("environment", "", "The environment the leases were granted in. Defaults to the profile's environment.")
+	correction := fs.Float64("weight_correction", 0, "Actual weight of the requests, if it differs from the leased weight.")
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		*environment = or(*environment, hub.Environment)
+		if err := required(map[string]string{"environment": *environment}); err != nil {
+			return nil, err
+		}
+		tokens, err := args(fs, "tokens")
+		if err != nil {
+			return nil, err
+		}
+		req := &pb.SetTokenLeaseConsumedRequest{Tokens: tokens, Environment: *environment}
+		if isSet(fs, "weight_correction") {
+			req.WeightCorrection = proto.Float32(float32(*correction))
+		}
+		return pb.NewQuotaServiceClient(conn).SetTokenLeaseConsumed(ctx, req)
+	}
+}
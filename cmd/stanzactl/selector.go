@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+)
+
+// tagsFlag is a list of tags given as key=value pairs, separated by commas or by repeating the flag.
+type tagsFlag []*pb.Tag
+
+func (t *tagsFlag) String() string {
+	var s []string
+	for _, tag := range *t {
+		s = append(s, tag.GetKey()+"="+tag.GetValue())
+	}
+	return strings.Join(s, ",")
+}
+
+func (t *tagsFlag) Set(v string) error {
+	for _, kv := range strings.Split(v, ",") {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return fmt.Errorf("tag %q is not key=value", kv)
+		}
+		*t = append(*t, &pb.Tag{Key: key, Value: value})
+	}
+	return nil
+}
+
+// guardFlags select a Guard, and optionally one of its features.
+type guardFlags struct {
+	fs          *flag.FlagSet
+	guard       string
+	environment string
+	feature     string
+	tags        tagsFlag
+}
+
+func newGuardFlags(fs *flag.FlagSet, feature bool) *guardFlags {
+	g := &guardFlags{fs: fs}
+	fs.StringVar(&g.guard, "guard", "", "The Guard name. Defaults to the profile's guard.")
+	fs.StringVar(&g.environment, "environment", "", "The environment of the Guard. Defaults to the profile's environment.")
+	if feature {
+		fs.StringVar(&g.feature, "feature", "", "The feature name, if any.")
+	}
+	fs.Var(&g.tags, "tags", "Tags as key=value pairs, e.g. \"customer_id=cust-1,tier=paid\".")
+	return g
+}
+
+// resolve defaults the Guard and environment to hub's, and checks they are set.
+func (g *guardFlags) resolve(hub *hubclient.Flags) error {
+	g.guard = or(g.guard, hub.Guard)
+	g.environment = or(g.environment, hub.Environment)
+	return required(map[string]string{"guard": g.guard, "environment": g.environment})
+}
+
+func (g *guardFlags) featureSelector() *pb.GuardFeatureSelector {
+	s := &pb.GuardFeatureSelector{
+		Environment: g.environment,
+		GuardName:   g.guard,
+		Tags:        g.tags,
+	}
+	if isSet(g.fs, "feature") {
+		s.FeatureName = &g.feature
+	}
+	return s
+}
+
+func (g *guardFlags) guardSelector() *pb.GuardSelector {
+	return &pb.GuardSelector{Environment: g.environment, Name: g.guard, Tags: g.tags}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/hubclient"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func usageQuery(fs *flag.FlagSet) runFunc {
+	var tags tagsFlag
+	environment := fs.String("environment", "", "The environment to report usage for. Defaults to the profile's environment.")
+	guard := fs.String("guard", "", "Only report usage of this Guard.")
+	feature := fs.String("feature", "", "Only report usage of this feature.")
+	service := fs.String("service", "", "Only report usage by this service.")
+	priority := fs.Int("priority", 0, "Only report usage at this priority.")
+	queryKey := fs.String("query_apikey", "", "Only report usage made with this API key.")
+	start := fs.String("start", "1h", "Start of the period, as a duration before now or an RFC 3339 time.")
+	end := fs.String("end", "0s", "End of the period, as a duration before now or an RFC 3339 time.")
+	step := fs.String("step", "", "Step between data points, 1m to 1w. Defaults to fewer than 100 data points.")
+	reportTags := fs.String("report_tags", "", "Comma separated tag keys to report a timeseries for each value of.")
+	reportAll := fs.Bool("report_all_tags", false, "Report a timeseries for every value of every tag.")
+	modes := map[string]*string{}
+	for _, axis := range []string{"guard", "feature", "service", "priority"} {
+		modes[axis] = fs.String(axis+"_mode", "", "Query mode for "+axis+": sum or report.")
+	}
+	fs.Var(&tags, "tags", "Only report usage with these tags, as key=value pairs.")
+
+	return func(ctx context.Context, conn grpc.ClientConnInterface, hub *hubclient.Flags) (proto.Message, error) {
+		*environment = or(*environment, hub.Environment)
+		if err := required(map[string]string{"environment": *environment}); err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		startTs, err := parseTime(*start, now)
+		if err != nil {
+			return nil, fmt.Errorf("bad -start: %v", err)
+		}
+		endTs, err := parseTime(*end, now)
+		if err != nil {
+			return nil, fmt.Errorf("bad -end: %v", err)
+		}
+		req := &pb.GetUsageRequest{
+			Environment: *environment,
+			StartTs:     timestamppb.New(startTs),
+			EndTs:       timestamppb.New(endTs),
+			Tags:        tags,
+		}
+		optional := func(name string, v *string) *string {
+			if isSet(fs, name) {
+				return v
+			}
+			return nil
+		}
+		req.Guard = optional("guard", guard)
+		req.Feature = optional("feature", feature)
+		req.Service = optional("service", service)
+		req.Apikey = optional("query_apikey", queryKey)
+		req.Step = optional("step", step)
+		if isSet(fs, "priority") {
+			req.Priority = proto.Int32(int32(*priority))
+		}
+		if *reportTags != "" {
+			req.ReportTags = strings.Split(*reportTags, ",")
+		}
+		if isSet(fs, "report_all_tags") {
+			req.ReportAllTags = reportAll
+		}
+		for axis, p := range map[string]**pb.QueryMode{"guard": &req.GuardQueryMode, "feature": &req.FeatureQueryMode, "service": &req.ServiceQueryMode, "priority": &req.PriorityQueryMode} {
+			if *modes[axis] == "" {
+				continue
+			}
+			m, ok := pb.QueryMode_value["QUERY_MODE_"+strings.ToUpper(*modes[axis])]
+			if !ok {
+				return nil, fmt.Errorf("bad -%s_mode %q, must be sum or report", axis, *modes[axis])
+			}
+			*p = pb.QueryMode(m).Enum()
+		}
+		return pb.NewUsageServiceClient(conn).GetUsage(ctx, req)
+	}
+}
+
+// parseTime parses s as either an RFC 3339 time or a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,337 @@
+// Package compare runs the same stream traffic against two targets, such as two hubs or two
+// Guards configured with different allocation policies, and reports where their allocations differ.
+package compare
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/output"
+	"github.com/StanzaSystems/stream-demo/scenario"
+	"github.com/StanzaSystems/stream-demo/streams"
+)
+
+// Updater issues UpdateStreams calls. It is satisfied by *streams.Client.
+type Updater interface {
+	Update(ctx context.Context, reqs []*pb.StreamRequest, ended []string) (*pb.UpdateStreamsResponse, error)
+}
+
+// Step is one UpdateStreams call sent to both targets.
+type Step struct {
+	Label string
+	Add   []*pb.StreamRequest
+	End   []string
+}
+
+// FromScenario returns the steps of a scenario.
+func FromScenario(sc *scenario.Scenario) []Step {
+	steps := make([]Step, 0, len(sc.Steps))
+	for _, s := range sc.Steps {
+		steps = append(steps, Step{Label: s.Narration, Add: s.Add, End: s.End})
+	}
+	return steps
+}
+
+// FromRecords returns one step for every recorded call.
+func FromRecords(recs []*streams.Record) []Step {
+	steps := make([]Step, 0, len(recs))
+	for i, rec := range recs {
+		steps = append(steps, Step{
+			Label: fmt.Sprintf("recorded call %d at %s", i, rec.Time.Format("15:04:05.000")),
+			Add:   rec.Request.GetRequests(),
+			End:   rec.Request.GetEnded(),
+		})
+	}
+	return steps
+}
+
+// Options control the comparison.
+type Options struct {
+	Tolerance float32 // allowed difference between the targets' weights for a stream
+	Limit     float32 // if set, totals are also reported as utilization of this limit
+	OnlyDiffs bool    // only print steps where the targets disagree
+}
+
+// side is the state of the streams on one target.
+type side struct {
+	allocated map[string]float32
+	totalSum  float64 // total allocated weight summed over steps
+	shareSum  map[string]float64
+}
+
+func newSide() *side {
+	return &side{allocated: make(map[string]float32), shareSum: make(map[string]float64)}
+}
+
+func (s *side) apply(step Step, res *pb.UpdateStreamsResponse) {
+	for _, id := range step.End {
+		delete(s.allocated, id)
+	}
+	for _, r := range res.GetResults() {
+		s.allocated[r.GetStreamId()] = r.GetAllocatedWeight()
+	}
+}
+
+func (s *side) total() float64 {
+	var t float64
+	for _, w := range s.allocated {
+		t += float64(w)
+	}
+	return t
+}
+
+func (s *side) byCustomer(customers map[string]string) map[string]float64 {
+	m := make(map[string]float64)
+	for id, w := range s.allocated {
+		m[customers[id]] += float64(w)
+	}
+	return m
+}
+
+// Summary describes where the two targets disagreed over a whole run.
+type Summary struct {
+	Steps          int
+	DisagreedSteps int
+	Compared       int // stream allocations compared
+	Differed       int // stream allocations which differed by more than the tolerance
+	SumAbsDiff     float64
+	MaxAbsDiff     float64
+	MaxDiffStream  string
+	MaxDiffStep    int
+	ErrorsA        int
+	ErrorsB        int
+	MeanTotalA     float64
+	MeanTotalB     float64
+	MeanShareA     map[string]float64 // mean share of the total allocation, by customer
+	MeanShareB     map[string]float64
+	limit          float32
+}
+
+// Run sends every step to a and b concurrently and writes a per-step comparison to out. Steps which fail on either
+// target are reported but not compared; the other target's response to them is still applied.
+func Run(ctx context.Context, a, b Updater, steps []Step, opts Options, out io.Writer) (*Summary, error) {
+	sa, sb := newSide(), newSide()
+	customers := make(map[string]string) // stream ID to customer
+	sum := &Summary{limit: opts.Limit}
+	compared := 0 // steps where both targets responded
+
+	for i, step := range steps {
+		if err := ctx.Err(); err != nil {
+			return sum, err
+		}
+		for _, r := range step.Add {
+			customers[r.GetStreamId()] = customerOf(r)
+		}
+
+		var resA, resB *pb.UpdateStreamsResponse
+		var errA, errB error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); resA, errA = a.Update(ctx, step.Add, step.End) }()
+		go func() { defer wg.Done(); resB, errB = b.Update(ctx, step.Add, step.End) }()
+		wg.Wait()
+
+		sum.Steps++
+		if errA != nil || errB != nil {
+			// The target which did respond has still run the step, so its streams are kept up to date
+			// and later steps compare what each target has really allocated.
+			if errA != nil {
+				sum.ErrorsA++
+			} else {
+				sa.apply(step, resA)
+			}
+			if errB != nil {
+				sum.ErrorsB++
+			} else {
+				sb.apply(step, resB)
+			}
+			fmt.Fprintf(out, "Step %d: %s\n  A error: %v\n  B error: %v\n\n", i, step.Label, errA, errB)
+			continue
+		}
+		compared++
+		sa.apply(step, resA)
+		sb.apply(step, resB)
+
+		disagreed := sum.compareStep(i, sa, sb, opts.Tolerance)
+		if disagreed {
+			sum.DisagreedSteps++
+		}
+
+		totalA, totalB := sa.total(), sb.total()
+		sa.totalSum += totalA
+		sb.totalSum += totalB
+		custA, custB := sa.byCustomer(customers), sb.byCustomer(customers)
+		for c, w := range custA {
+			sa.shareSum[c] += share(w, totalA)
+		}
+		for c, w := range custB {
+			sb.shareSum[c] += share(w, totalB)
+		}
+
+		if disagreed || !opts.OnlyDiffs {
+			writeStep(out, i, step, sa, sb, customers, opts)
+		}
+	}
+
+	if compared > 0 {
+		n := float64(compared)
+		sum.MeanTotalA = sa.totalSum / n
+		sum.MeanTotalB = sb.totalSum / n
+		sum.MeanShareA = means(sa.shareSum, n)
+		sum.MeanShareB = means(sb.shareSum, n)
+	}
+	return sum, nil
+}
+
+// compareStep records the differences between the sides after step i, reporting whether there were any.
+func (sum *Summary) compareStep(i int, sa, sb *side, tolerance float32) bool {
+	disagreed := false
+	for _, id := range unionIDs(sa, sb) {
+		wa, wb := sa.allocated[id], sb.allocated[id]
+		diff := math.Abs(float64(wa - wb))
+		sum.Compared++
+		sum.SumAbsDiff += diff
+		if diff > sum.MaxAbsDiff {
+			sum.MaxAbsDiff, sum.MaxDiffStream, sum.MaxDiffStep = diff, id, i
+		}
+		if diff > float64(tolerance) {
+			sum.Differed++
+			disagreed = true
+		}
+	}
+	return disagreed
+}
+
+func writeStep(w io.Writer, i int, step Step, sa, sb *side, customers map[string]string, opts Options) {
+	fmt.Fprintf(w, "Step %d: %s\n", i, step.Label)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  STREAM\tCUSTOMER\tA\tB\tDIFF\n")
+	for _, id := range unionIDs(sa, sb) {
+		wa, wb := sa.allocated[id], sb.allocated[id]
+		diff := ""
+		if d := wb - wa; d > opts.Tolerance || d < -opts.Tolerance {
+			diff = fmt.Sprintf("%+.2f *", d)
+		}
+		fmt.Fprintf(tw, "  %s\t%s\t%.2f\t%.2f\t%s\n", id, orDash(customers[id]), wa, wb, diff)
+	}
+	totalA, totalB := sa.total(), sb.total()
+	fmt.Fprintf(tw, "  TOTAL\t\t%s\t%s\t%+.2f\n", formatTotal(totalA, opts.Limit), formatTotal(totalB, opts.Limit), totalB-totalA)
+	tw.Flush()
+
+	custA, custB := sa.byCustomer(customers), sb.byCustomer(customers)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  CUSTOMER\tA SHARE\tB SHARE\n")
+	for _, c := range unionKeys(custA, custB) {
+		fmt.Fprintf(tw, "  %s\t%.1f%%\t%.1f%%\n", orDash(c), 100*share(custA[c], totalA), 100*share(custB[c], totalB))
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n")
+}
+
+// Write prints the summary.
+func (sum *Summary) Write(w io.Writer) {
+	fmt.Fprintf(w, "Compared %d steps: the targets disagreed on %d.\n", sum.Steps, sum.DisagreedSteps)
+	fmt.Fprintf(w, "Errors: %d from A, %d from B.\n", sum.ErrorsA, sum.ErrorsB)
+	if sum.Compared > 0 {
+		fmt.Fprintf(w, "Stream allocations: %d of %d differed, mean absolute difference %.3f", sum.Differed, sum.Compared, sum.SumAbsDiff/float64(sum.Compared))
+		if sum.MaxAbsDiff > 0 {
+			fmt.Fprintf(w, ", largest %.3f for %s at step %d", sum.MaxAbsDiff, sum.MaxDiffStream, sum.MaxDiffStep)
+		}
+		fmt.Fprintf(w, ".\n")
+	}
+	fmt.Fprintf(w, "Mean total allocated: A %s, B %s.\n", formatTotal(sum.MeanTotalA, sum.limit), formatTotal(sum.MeanTotalB, sum.limit))
+
+	customers := unionKeys(sum.MeanShareA, sum.MeanShareB)
+	if len(customers) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "CUSTOMER\tMEAN A SHARE\tMEAN B SHARE\tDIFF\n")
+	for _, c := range customers {
+		a, b := 100*sum.MeanShareA[c], 100*sum.MeanShareB[c]
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%.1f%%\t%+.1f\n", orDash(c), a, b, b-a)
+	}
+	tw.Flush()
+}
+
+// Disagreed reports whether the targets allocated any stream differently, or failed differently.
+func (sum *Summary) Disagreed() bool {
+	return sum.DisagreedSteps > 0 || sum.ErrorsA != sum.ErrorsB
+}
+
+func customerOf(r *pb.StreamRequest) string {
+	for _, t := range r.GetTags() {
+		if t.GetKey() == output.CustomerTag {
+			return t.GetValue()
+		}
+	}
+	return ""
+}
+
+func unionIDs(sa, sb *side) []string {
+	seen := make(map[string]bool)
+	for id := range sa.allocated {
+		seen[id] = true
+	}
+	for id := range sb.allocated {
+		seen[id] = true
+	}
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func unionKeys(a, b map[string]float64) []string {
+	seen := make(map[string]bool)
+	for k := range a {
+		seen[k] = true
+	}
+	for k := range b {
+		seen[k] = true
+	}
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func means(sums map[string]float64, n float64) map[string]float64 {
+	m := make(map[string]float64, len(sums))
+	for k, v := range sums {
+		m[k] = v / n
+	}
+	return m
+}
+
+func share(w, total float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return w / total
+}
+
+func formatTotal(total float64, limit float32) string {
+	if limit > 0 {
+		return fmt.Sprintf("%.2f (%.0f%%)", total, 100*total/float64(limit))
+	}
+	return fmt.Sprintf("%.2f", total)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
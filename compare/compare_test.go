@@ -0,0 +1,59 @@
+package compare
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// fakeTarget allocates every added stream its MaxWeight, failing the calls numbered in fail.
+type fakeTarget struct {
+	calls int
+	fail  map[int]bool
+}
+
+func (f *fakeTarget) Update(ctx context.Context, reqs []*pb.StreamRequest, ended []string) (*pb.UpdateStreamsResponse, error) {
+	defer func() { f.calls++ }()
+	if f.fail[f.calls] {
+		return nil, errors.New("unavailable")
+	}
+	res := &pb.UpdateStreamsResponse{}
+	for _, r := range reqs {
+		res.Results = append(res.Results, &pb.StreamResult{StreamId: r.GetStreamId(), AllocatedWeight: r.GetMaxWeight()})
+	}
+	return res, nil
+}
+
+func TestRunOneSidedError(t *testing.T) {
+	stream := func(id string) []*pb.StreamRequest { return []*pb.StreamRequest{{StreamId: id, MaxWeight: 5}} }
+	tests := []struct {
+		name     string
+		failA    map[int]bool
+		failB    map[int]bool
+		differed int
+	}{
+		{"no errors", nil, nil, 0},
+		// A allocated s1 even though B failed, so after the next step A has s1 and B doesn't.
+		{"B fails", nil, map[int]bool{0: true}, 1},
+		{"A fails", map[int]bool{0: true}, nil, 1},
+		{"both fail", map[int]bool{0: true}, map[int]bool{0: true}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := []Step{{Label: "add s1", Add: stream("s1")}, {Label: "add s2", Add: stream("s2")}}
+			sum, err := Run(context.Background(), &fakeTarget{fail: tt.failA}, &fakeTarget{fail: tt.failB}, steps, Options{}, io.Discard)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum.Differed != tt.differed {
+				t.Errorf("got %d differing allocations, want %d", sum.Differed, tt.differed)
+			}
+			if sum.ErrorsA != len(tt.failA) || sum.ErrorsB != len(tt.failB) {
+				t.Errorf("got %d and %d errors", sum.ErrorsA, sum.ErrorsB)
+			}
+		})
+	}
+}
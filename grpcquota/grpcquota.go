@@ -0,0 +1,188 @@
+// Package grpcquota has gRPC server interceptors which admit calls only if Stanza grants them quota.
+//
+// Each call is mapped to a Guard, feature, priority boost, weight and tags by the Extractors in a Config,
+// usually from its method name and incoming metadata, and a token is requested for it from a lease.Cache
+// or lease.Direct. Calls which are refused quota fail with codes.ResourceExhausted, with a GetTokenResponse
+// status detail carrying the Reason. Guards in report-only mode never refuse calls.
+package grpcquota
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Extractor derives a value from a call, given its context and full method name
+// ("/package.Service/Method"), returning "" if the call has none. Any function can be used as a custom Extractor.
+type Extractor func(ctx context.Context, method string) string
+
+// Const always returns v.
+func Const(v string) Extractor {
+	return func(context.Context, string) string { return v }
+}
+
+// Metadata returns the first value of the named incoming metadata key.
+func Metadata(key string) Extractor {
+	return func(ctx context.Context, _ string) string {
+		if v := metadata.ValueFromIncomingContext(ctx, key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// Method maps full method names, or prefixes of them such as "/package.Service/", to values,
+// returning the value of the longest prefix which matches.
+func Method(prefixes map[string]string) Extractor {
+	return func(_ context.Context, method string) string {
+		best, value := -1, ""
+		for prefix, v := range prefixes {
+			if strings.HasPrefix(method, prefix) && len(prefix) > best {
+				best, value = len(prefix), v
+			}
+		}
+		return value
+	}
+}
+
+// MethodName returns the method's name without its service, for using methods as features.
+func MethodName(_ context.Context, method string) string {
+	return method[strings.LastIndex(method, "/")+1:]
+}
+
+// DefaultTimeout bounds how long a call waits for quota if Config.Timeout is unset.
+const DefaultTimeout = time.Second
+
+// Config says how calls are mapped to quota, and what to do with the decision.
+type Config struct {
+	Environment string
+	Guard       Extractor
+	Feature     Extractor            // optional
+	Tags        map[string]Extractor // tag key to value; tags with no value are left out
+	// PriorityBoost and Weight are optional, and must extract an integer and a number respectively.
+	PriorityBoost Extractor
+	Weight        Extractor
+	// Selector, if set, is a custom mapping used instead of all of the Extractors above.
+	Selector func(ctx context.Context, method string) (sel lease.Selector, weight float32, err error)
+
+	// Reporter, if set, reports leased tokens as consumed once the call has completed.
+	Reporter *lease.Reporter
+	// Timeout bounds how long a call waits for quota. DefaultTimeout if unset.
+	Timeout time.Duration
+	// FailClosed refuses calls, with codes.Unavailable, when quota could not be checked. By default they are let through.
+	FailClosed bool
+	// OnDecision, if set, is called with every decision, for metrics and logging.
+	OnDecision func(ctx context.Context, method string, d *lease.Decision)
+}
+
+type contextKey struct{}
+
+// FromContext returns the Decision made for the call with context ctx, or nil.
+func FromContext(ctx context.Context) *lease.Decision {
+	d, _ := ctx.Value(contextKey{}).(*lease.Decision)
+	return d
+}
+
+// UnaryServerInterceptor checks the quota of every unary call with tokens.
+func UnaryServerInterceptor(tokens lease.Tokens, cfg Config) grpc.UnaryServerInterceptor {
+	decider := cfg.decider(tokens)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		d, err := cfg.check(ctx, info.FullMethod, decider)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Report(cfg.Reporter)
+		return handler(context.WithValue(ctx, contextKey{}, d), req)
+	}
+}
+
+// StreamServerInterceptor checks the quota of every streaming call with tokens, once when the stream is opened.
+func StreamServerInterceptor(tokens lease.Tokens, cfg Config) grpc.StreamServerInterceptor {
+	decider := cfg.decider(tokens)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		d, err := cfg.check(ss.Context(), info.FullMethod, decider)
+		if err != nil {
+			return err
+		}
+		defer d.Report(cfg.Reporter)
+		return handler(srv, &serverStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), contextKey{}, d)})
+	}
+}
+
+// serverStream overrides the context of a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+func (cfg *Config) decider(tokens lease.Tokens) lease.Decider {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	return lease.Decider{Tokens: tokens, Timeout: cfg.Timeout, FailClosed: cfg.FailClosed}
+}
+
+// check decides whether the call may go ahead, returning the error to fail it with if not.
+func (cfg *Config) check(ctx context.Context, method string, decider lease.Decider) (*lease.Decision, error) {
+	sel, weight, err := cfg.selector(ctx, method)
+	d := decider.Decide(ctx, sel, weight, err)
+	if cfg.OnDecision != nil {
+		cfg.OnDecision(ctx, method, d)
+	}
+	if d.Allowed {
+		return d, nil
+	}
+	if d.Quota != pb.Quota_QUOTA_BLOCKED {
+		return d, status.Errorf(codes.Unavailable, "could not check quota for %s: %v", method, d.Err)
+	}
+	st := status.Newf(codes.ResourceExhausted, "quota exhausted for %s: %s", method, d.Grant.Reason)
+	if withDetail, err := st.WithDetails(&pb.GetTokenResponse{
+		Granted: false,
+		Reason:  d.Grant.Reason.Enum(),
+		Mode:    d.Grant.Mode.Enum(),
+	}); err == nil {
+		st = withDetail
+	}
+	return d, st.Err()
+}
+
+func (cfg *Config) selector(ctx context.Context, method string) (lease.Selector, float32, error) {
+	if cfg.Selector != nil {
+		return cfg.Selector(ctx, method)
+	}
+	extract := func(e Extractor) string {
+		if e == nil {
+			return ""
+		}
+		return e(ctx, method)
+	}
+	f := lease.Fields{
+		Environment:   cfg.Environment,
+		Guard:         extract(cfg.Guard),
+		Feature:       extract(cfg.Feature),
+		Tags:          make(map[string]string, len(cfg.Tags)),
+		PriorityBoost: extract(cfg.PriorityBoost),
+		Weight:        extract(cfg.Weight),
+	}
+	for key, e := range cfg.Tags {
+		f.Tags[key] = e(ctx, method)
+	}
+	sel, weight, err := f.Selector()
+	if err != nil {
+		return sel, 0, fmt.Errorf("%s: %w", method, err)
+	}
+	return sel, weight, nil
+}
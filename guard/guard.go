@@ -0,0 +1,419 @@
+// Package guard runs requests through the full Stanza Guard pipeline: it loads the Guard's
+// configuration, evaluates local rules, validates ingress tokens and checks quota, and records
+// the outcome of every stage in a Status.
+package guard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+	"github.com/StanzaSystems/stream-demo/tokens"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// TokenHeader is the header, or gRPC metadata key, which carries ingress tokens.
+const TokenHeader = "X-Stanza-Token"
+
+// Defaults for the Guard options.
+const (
+	DefaultConfigRefresh = 30 * time.Second
+	DefaultTimeout       = time.Second
+)
+
+// retryBackoff is how long to wait before fetching config again after a failure.
+const retryBackoff = 5 * time.Second
+
+// Request is a single request passing through a Guard.
+type Request struct {
+	Feature       string
+	PriorityBoost int32
+	Weight        float32
+	Tags          []*pb.Tag // all of the request's tags; only the Guard's quota tags are sent to the hub
+	Token         string    // the ingress token, if any
+}
+
+// LocalEvaluator evaluates rules which are enforced locally rather than by the hub, such as Sentinel rules.
+// Evaluators which track requests in flight, for concurrency limits, also return a function to be called once the
+// request has finished, with its error, or with ErrBlocked if a later stage blocked it; others return nil.
+type LocalEvaluator interface {
+	Evaluate(ctx context.Context, req *Request) (pb.Local, func(err error))
+}
+
+// ErrBlocked is passed to a LocalEvaluator's done function when the request was blocked after local evaluation.
+var ErrBlocked = errors.New("blocked by Guard")
+
+// Validator validates ingress tokens. It is satisfied by *tokens.Validator.
+type Validator interface {
+	Validate(ctx context.Context, token string, guard *pb.GuardSelector) pb.Token
+}
+
+// Status is the outcome of every stage of a Guard decision.
+type Status struct {
+	Config  pb.Config
+	Local   pb.Local
+	Token   pb.Token
+	Quota   pb.Quota
+	Mode    pb.Mode
+	Allowed bool
+	Grant   *lease.Grant // the quota token, if quota was checked; leased tokens should be reported with lease.Reporter
+	Err     error        // the first error from any stage, which may not have blocked the request
+
+	done func(err error)
+}
+
+// Done must be called when an allowed request has finished, with its error if it failed.
+// It is a no-op for blocked requests, and after the first call.
+func (s *Status) Done(err error) {
+	if s.done != nil {
+		s.done(err)
+		s.done = nil
+	}
+}
+
+// String summarises the status on one line.
+func (s *Status) String() string {
+	verdict := "blocked"
+	if s.Allowed {
+		verdict = "allowed"
+	}
+	return fmt.Sprintf("%s config=%s local=%s token=%s quota=%s mode=%s", verdict, s.Config, s.Local, s.Token, s.Quota, s.Mode)
+}
+
+// LogValue logs the status as a group of its stages.
+func (s *Status) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Bool("allowed", s.Allowed),
+		slog.String("config", s.Config.String()),
+		slog.String("local", s.Local.String()),
+		slog.String("token", s.Token.String()),
+		slog.String("quota", s.Quota.String()),
+		slog.String("mode", s.Mode.String()),
+	}
+	if s.Err != nil {
+		attrs = append(attrs, slog.String("error", s.Err.Error()))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// Guard makes decisions for a single Guard. It is safe for concurrent use.
+type Guard struct {
+	name           string
+	environment    string
+	service        string
+	release        string
+	apikey         string
+	configs        pb.ConfigServiceClient
+	tokens         lease.Tokens
+	validator      Validator
+	local          LocalEvaluator
+	refresh        time.Duration
+	timeout        time.Duration
+	onConfigChange func(*pb.GuardConfig)
+
+	mu         sync.Mutex
+	config     *pb.GuardConfig
+	version    string
+	fetched    time.Time
+	loading    *fetch    // the fetch in progress, if any
+	retryAt    time.Time // after a failed fetch, when to try again
+	lastStatus pb.Config // status of the last failed fetch
+	lastErr    error
+}
+
+// fetch is a GetGuardConfig call, whose result is shared by every request waiting for config.
+type fetch struct {
+	done   chan struct{} // closed once the fields below are set
+	config *pb.GuardConfig
+	status pb.Config
+	err    error
+}
+
+// Option configures a Guard.
+type Option func(*Guard)
+
+// WithService names the service loading the Guard, which is sent with config requests.
+func WithService(name, release string) Option {
+	return func(g *Guard) {
+		g.service, g.release = name, release
+	}
+}
+
+// WithTokens sets where quota tokens come from. By default every request calls GetToken.
+func WithTokens(t lease.Tokens) Option {
+	return func(g *Guard) {
+		g.tokens = t
+	}
+}
+
+// WithValidator sets how ingress tokens are validated. By default a tokens.Validator is used.
+func WithValidator(v Validator) Option {
+	return func(g *Guard) {
+		g.validator = v
+	}
+}
+
+// WithLocal evaluates local rules with e. Without one, the Local status is LOCAL_NOT_SUPPORTED.
+func WithLocal(e LocalEvaluator) Option {
+	return func(g *Guard) {
+		g.local = e
+	}
+}
+
+// WithConfigRefresh checks for new config at most this often.
+func WithConfigRefresh(d time.Duration) Option {
+	return func(g *Guard) {
+		g.refresh = d
+	}
+}
+
+// WithTimeout bounds each call to the hub, including config fetches.
+func WithTimeout(d time.Duration) Option {
+	return func(g *Guard) {
+		g.timeout = d
+	}
+}
+
+// WithConfigChange calls f whenever a new version of the Guard's config is loaded.
+func WithConfigChange(f func(*pb.GuardConfig)) Option {
+	return func(g *Guard) {
+		g.onConfigChange = f
+	}
+}
+
+// New returns the named Guard, which authenticates to the hub on conn with apikey.
+func New(conn grpc.ClientConnInterface, apikey, name, environment string, opts ...Option) *Guard {
+	g := &Guard{
+		name:        name,
+		environment: environment,
+		apikey:      apikey,
+		configs:     pb.NewConfigServiceClient(conn),
+		refresh:     DefaultConfigRefresh,
+		timeout:     DefaultTimeout,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.tokens == nil {
+		g.tokens = lease.NewDirect(conn, apikey, "")
+	}
+	if g.validator == nil {
+		g.validator = tokens.NewValidator(conn, apikey)
+	}
+	return g
+}
+
+// Load fetches the Guard's config, so that the first request does not have to wait for it. It waits for the fetch
+// until ctx is done, and the fetch itself is bounded by the Guard's timeout.
+func (g *Guard) Load(ctx context.Context) error {
+	_, _, err := g.fetchConfig(ctx)
+	return err
+}
+
+// Config returns the Guard's current config, or nil if it has not been loaded.
+func (g *Guard) Config() *pb.GuardConfig {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.config
+}
+
+// Check runs req through the pipeline. Requests are only blocked by a local rule, an invalid
+// ingress token or a lack of quota, and never in report-only mode; if a stage fails, the request is let through.
+func (g *Guard) Check(ctx context.Context, req *Request) *Status {
+	st := &Status{
+		Local:   pb.Local_LOCAL_NOT_EVAL,
+		Token:   pb.Token_TOKEN_NOT_EVAL,
+		Quota:   pb.Quota_QUOTA_NOT_EVAL,
+		Mode:    pb.Mode_MODE_NORMAL,
+		Allowed: true,
+	}
+	var config *pb.GuardConfig
+	config, st.Config, st.Err = g.getConfig(ctx)
+	if config == nil {
+		return st
+	}
+	if config.GetReportOnly() {
+		st.Mode = pb.Mode_MODE_REPORT_ONLY
+	}
+	blocked := false
+
+	st.Local = pb.Local_LOCAL_NOT_SUPPORTED
+	if g.local != nil {
+		st.Local, st.done = g.local.Evaluate(ctx, req)
+	}
+	blocked = st.Local == pb.Local_LOCAL_BLOCKED
+
+	if !blocked {
+		st.Token = pb.Token_TOKEN_EVAL_DISABLED
+		if config.GetValidateIngressTokens() {
+			tctx, cancel := context.WithTimeout(ctx, g.timeout)
+			st.Token = g.validator.Validate(tctx, req.Token, &pb.GuardSelector{Environment: g.environment, Name: g.name, Tags: quotaTags(config, req.Tags)})
+			cancel()
+		}
+		blocked = st.Token == pb.Token_TOKEN_NOT_VALID
+	}
+
+	if !blocked {
+		st.Quota = pb.Quota_QUOTA_EVAL_DISABLED
+		if config.GetCheckQuota() {
+			qctx, cancel := context.WithTimeout(ctx, g.timeout)
+			grant, err := g.tokens.Get(qctx, g.selector(config, req), req.Weight)
+			cancel()
+			st.Quota = lease.Status(grant, err)
+			if err != nil {
+				st.Err = errors.Join(st.Err, err)
+			} else {
+				st.Grant = grant
+				if grant.Mode == pb.Mode_MODE_REPORT_ONLY {
+					st.Mode = pb.Mode_MODE_REPORT_ONLY
+				}
+			}
+		}
+		blocked = st.Quota == pb.Quota_QUOTA_BLOCKED
+	}
+
+	st.Allowed = !blocked || st.Mode == pb.Mode_MODE_REPORT_ONLY
+	if !st.Allowed {
+		st.Done(ErrBlocked)
+	}
+	return st
+}
+
+// selector returns the quota selector for req, with only the Guard's quota tags.
+func (g *Guard) selector(config *pb.GuardConfig, req *Request) lease.Selector {
+	return lease.Selector{Environment: g.environment, Guard: g.name, Feature: req.Feature, PriorityBoost: req.PriorityBoost, Tags: quotaTags(config, req.Tags)}
+}
+
+// quotaTags returns the tags which the config names as quota tags.
+func quotaTags(config *pb.GuardConfig, tags []*pb.Tag) []*pb.Tag {
+	var quota []*pb.Tag
+	for _, t := range tags {
+		for _, key := range config.GetQuotaTags() {
+			if t.GetKey() == key {
+				quota = append(quota, t)
+				break
+			}
+		}
+	}
+	return quota
+}
+
+// getConfig returns the config to use for a request. The first requests wait for a single fetch; after that the
+// cached config is used, and refreshed in the background once it is older than the refresh interval.
+func (g *Guard) getConfig(ctx context.Context) (*pb.GuardConfig, pb.Config, error) {
+	g.mu.Lock()
+	config := g.config
+	now := time.Now()
+	if config != nil {
+		if now.Sub(g.fetched) > g.refresh && now.After(g.retryAt) && g.loading == nil {
+			g.startFetch()
+		}
+		g.mu.Unlock()
+		return config, pb.Config_CONFIG_CACHED_OK, nil
+	}
+	if now.Before(g.retryAt) {
+		// Don't make every request wait for a hub which has just failed.
+		defer g.mu.Unlock()
+		return nil, g.lastStatus, g.lastErr
+	}
+	g.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	return g.fetchConfig(ctx)
+}
+
+// fetchConfig asks the hub for a newer config, or joins the fetch already in progress, and waits for it until ctx
+// is done. On failure, the cached config is returned with the failure's status.
+func (g *Guard) fetchConfig(ctx context.Context) (*pb.GuardConfig, pb.Config, error) {
+	g.mu.Lock()
+	f := g.loading
+	if f == nil {
+		f = g.startFetch()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.config, f.status, f.err
+	case <-ctx.Done():
+		return g.Config(), configStatus(ctx.Err()), fmt.Errorf("loading config for Guard %q: %w", g.name, ctx.Err())
+	}
+}
+
+// startFetch starts fetching config in the background. g.mu must be held.
+func (g *Guard) startFetch() *fetch {
+	f := &fetch{done: make(chan struct{})}
+	g.loading = f
+	req := &pb.GetGuardConfigRequest{
+		Selector: &pb.GuardServiceSelector{
+			Environment:    g.environment,
+			GuardName:      g.name,
+			ServiceName:    g.service,
+			ServiceRelease: g.release,
+		},
+	}
+	if g.version != "" {
+		req.VersionSeen = proto.String(g.version)
+	}
+	go g.fetch(f, req)
+	return f
+}
+
+// fetch makes the GetGuardConfig call for f. It isn't bound to any one request's context, since others may be
+// waiting for it too.
+func (g *Guard) fetch(f *fetch, req *pb.GetGuardConfigRequest) {
+	defer close(f.done)
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", g.apikey)
+	res, err := g.configs.GetGuardConfig(ctx, req)
+
+	g.mu.Lock()
+	g.loading = nil
+	if err != nil {
+		result := configStatus(err)
+		err = fmt.Errorf("loading config for Guard %q: %w", g.name, err)
+		g.retryAt, g.lastStatus, g.lastErr = time.Now().Add(retryBackoff), result, err
+		f.config, f.status, f.err = g.config, result, err
+		g.mu.Unlock()
+		return
+	}
+	g.fetched = time.Now()
+	changed := res.GetConfigDataSent() && res.GetConfig() != nil
+	if changed {
+		g.config, g.version = res.GetConfig(), res.GetVersion()
+	}
+	config := g.config
+	g.mu.Unlock()
+
+	if config == nil {
+		f.status, f.err = pb.Config_CONFIG_NOT_FOUND, fmt.Errorf("hub sent no config for Guard %q", g.name)
+		return
+	}
+	if changed && g.onConfigChange != nil {
+		g.onConfigChange(config)
+	}
+	f.config, f.status = config, pb.Config_CONFIG_FETCHED_OK
+}
+
+// configStatus returns the status of a failed config fetch.
+func configStatus(err error) pb.Config {
+	switch {
+	case status.Code(err) == codes.NotFound:
+		return pb.Config_CONFIG_NOT_FOUND
+	case status.Code(err) == codes.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded):
+		return pb.Config_CONFIG_FETCH_TIMEOUT
+	}
+	return pb.Config_CONFIG_FETCH_ERROR
+}
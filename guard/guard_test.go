@@ -0,0 +1,189 @@
+package guard
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// configHub answers GetGuardConfig with config, or err, counting the calls.
+type configHub struct {
+	config  *pb.GuardConfig
+	err     error
+	release chan struct{} // if set, calls wait until it is closed
+	calls   atomic.Int32
+}
+
+func (h *configHub) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	h.calls.Add(1)
+	if h.release != nil {
+		<-h.release
+	}
+	if h.err != nil {
+		return h.err
+	}
+	proto.Merge(reply.(proto.Message), &pb.GetGuardConfigResponse{Version: "1", ConfigDataSent: true, Config: h.config})
+	return nil
+}
+
+func (h *configHub) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	panic("not implemented")
+}
+
+// fakeLocal answers every request with local, recording how the request finished.
+type fakeLocal struct {
+	local pb.Local
+	done  bool
+	err   error
+}
+
+func (f *fakeLocal) Evaluate(ctx context.Context, req *Request) (pb.Local, func(err error)) {
+	return f.local, func(err error) { f.done, f.err = true, err }
+}
+
+// fakeValidator answers every token with token, recording the Guard it was asked about.
+type fakeValidator struct {
+	token pb.Token
+	guard *pb.GuardSelector
+}
+
+func (f *fakeValidator) Validate(ctx context.Context, token string, guard *pb.GuardSelector) pb.Token {
+	f.guard = guard
+	return f.token
+}
+
+// fakeTokens answers every quota request with grant and err, recording the selector.
+type fakeTokens struct {
+	grant *lease.Grant
+	err   error
+	sel   lease.Selector
+}
+
+func (f *fakeTokens) Get(ctx context.Context, sel lease.Selector, weight float32) (*lease.Grant, error) {
+	f.sel = sel
+	return f.grant, f.err
+}
+
+func TestCheck(t *testing.T) {
+	all := &pb.GuardConfig{ValidateIngressTokens: true, CheckQuota: true}
+	granted := &lease.Grant{Granted: true}
+	tests := []struct {
+		name      string
+		config    *pb.GuardConfig
+		configErr error
+		local     pb.Local // if unset, there is no LocalEvaluator
+		token     pb.Token
+		grant     *lease.Grant
+		quotaErr  error
+		expect    string // the Status
+		localErr  error  // passed to the LocalEvaluator's done function by the Guard
+	}{
+		{"allowed by every stage", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALID, granted, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALID quota=QUOTA_GRANTED mode=MODE_NORMAL", nil},
+		{"stages disabled", &pb.GuardConfig{}, nil, 0, pb.Token_TOKEN_NOT_VALID, &lease.Grant{}, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_NOT_SUPPORTED token=TOKEN_EVAL_DISABLED quota=QUOTA_EVAL_DISABLED mode=MODE_NORMAL", nil},
+		{"config error fails open", nil, status.Error(codes.Unavailable, "down"), pb.Local_LOCAL_BLOCKED, pb.Token_TOKEN_NOT_VALID, &lease.Grant{}, nil,
+			"allowed config=CONFIG_FETCH_ERROR local=LOCAL_NOT_EVAL token=TOKEN_NOT_EVAL quota=QUOTA_NOT_EVAL mode=MODE_NORMAL", nil},
+		{"config not found fails open", nil, status.Error(codes.NotFound, "no such guard"), pb.Local_LOCAL_BLOCKED, pb.Token_TOKEN_NOT_VALID, &lease.Grant{}, nil,
+			"allowed config=CONFIG_NOT_FOUND local=LOCAL_NOT_EVAL token=TOKEN_NOT_EVAL quota=QUOTA_NOT_EVAL mode=MODE_NORMAL", nil},
+		{"local error fails open", all, nil, pb.Local_LOCAL_ERROR, pb.Token_TOKEN_VALID, granted, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ERROR token=TOKEN_VALID quota=QUOTA_GRANTED mode=MODE_NORMAL", nil},
+		{"blocked locally", all, nil, pb.Local_LOCAL_BLOCKED, pb.Token_TOKEN_VALID, granted, nil,
+			"blocked config=CONFIG_FETCHED_OK local=LOCAL_BLOCKED token=TOKEN_NOT_EVAL quota=QUOTA_NOT_EVAL mode=MODE_NORMAL", ErrBlocked},
+		{"token validation error fails open", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALIDATION_ERROR, granted, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALIDATION_ERROR quota=QUOTA_GRANTED mode=MODE_NORMAL", nil},
+		{"token validation timeout fails open", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALIDATION_TIMEOUT, granted, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALIDATION_TIMEOUT quota=QUOTA_GRANTED mode=MODE_NORMAL", nil},
+		{"invalid token", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_NOT_VALID, granted, nil,
+			"blocked config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_NOT_VALID quota=QUOTA_NOT_EVAL mode=MODE_NORMAL", ErrBlocked},
+		{"quota error fails open", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALID, nil, errors.New("unavailable"),
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALID quota=QUOTA_ERROR mode=MODE_NORMAL", nil},
+		{"quota timeout fails open", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALID, nil, context.DeadlineExceeded,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALID quota=QUOTA_TIMEOUT mode=MODE_NORMAL", nil},
+		{"no quota", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALID, &lease.Grant{}, nil,
+			"blocked config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALID quota=QUOTA_BLOCKED mode=MODE_NORMAL", ErrBlocked},
+		{"report-only config", &pb.GuardConfig{ValidateIngressTokens: true, CheckQuota: true, ReportOnly: true}, nil, pb.Local_LOCAL_BLOCKED, pb.Token_TOKEN_VALID, granted, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_BLOCKED token=TOKEN_NOT_EVAL quota=QUOTA_NOT_EVAL mode=MODE_REPORT_ONLY", nil},
+		{"report-only grant", all, nil, pb.Local_LOCAL_ALLOWED, pb.Token_TOKEN_VALID, &lease.Grant{Mode: pb.Mode_MODE_REPORT_ONLY}, nil,
+			"allowed config=CONFIG_FETCHED_OK local=LOCAL_ALLOWED token=TOKEN_VALID quota=QUOTA_BLOCKED mode=MODE_REPORT_ONLY", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &configHub{config: tt.config, err: tt.configErr}
+			opts := []Option{
+				WithValidator(&fakeValidator{token: tt.token}),
+				WithTokens(&fakeTokens{grant: tt.grant, err: tt.quotaErr}),
+			}
+			local := &fakeLocal{local: tt.local}
+			if tt.local != 0 {
+				opts = append(opts, WithLocal(local))
+			}
+			g := New(hub, "key", "g", "prod", opts...)
+			st := g.Check(context.Background(), &Request{Token: "t"})
+			if got := st.String(); got != tt.expect {
+				t.Errorf("got  %s\nwant %s", got, tt.expect)
+			}
+			if (st.Err != nil) != (tt.configErr != nil || tt.quotaErr != nil) {
+				t.Errorf("got error %v", st.Err)
+			}
+			if st.Allowed {
+				st.Done(nil)
+			}
+			if local.done != (tt.local != 0 && st.Config == pb.Config_CONFIG_FETCHED_OK) || !errors.Is(local.err, tt.localErr) {
+				t.Errorf("local done %v with %v, want %v", local.done, local.err, tt.localErr)
+			}
+		})
+	}
+}
+
+func TestQuotaTags(t *testing.T) {
+	hub := &configHub{config: &pb.GuardConfig{ValidateIngressTokens: true, CheckQuota: true, QuotaTags: []string{"customer"}}}
+	validator := &fakeValidator{token: pb.Token_TOKEN_VALID}
+	tokens := &fakeTokens{grant: &lease.Grant{Granted: true}}
+	g := New(hub, "key", "g", "prod", WithValidator(validator), WithTokens(tokens))
+	g.Check(context.Background(), &Request{Tags: []*pb.Tag{{Key: "customer", Value: "c1"}, {Key: "path", Value: "/search"}}})
+
+	for name, tags := range map[string][]*pb.Tag{"token validation": validator.guard.GetTags(), "quota": tokens.sel.Tags} {
+		if len(tags) != 1 || tags[0].GetKey() != "customer" {
+			t.Errorf("%s got tags %v, want only customer", name, tags)
+		}
+	}
+}
+
+func TestConcurrentFirstChecks(t *testing.T) {
+	hub := &configHub{config: &pb.GuardConfig{}, release: make(chan struct{})}
+	g := New(hub, "key", "g", "prod", WithValidator(&fakeValidator{}), WithTokens(&fakeTokens{}))
+	var wg sync.WaitGroup
+	results := make([]pb.Config, 10)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = g.Check(context.Background(), &Request{}).Config
+		}(i)
+	}
+	// Hold the first fetch until the other checks are waiting for config too.
+	time.Sleep(50 * time.Millisecond)
+	close(hub.release)
+	wg.Wait()
+
+	if calls := hub.calls.Load(); calls != 1 {
+		t.Errorf("got %d GetGuardConfig calls, want 1", calls)
+	}
+	for i, got := range results {
+		if got != pb.Config_CONFIG_FETCHED_OK && got != pb.Config_CONFIG_CACHED_OK {
+			t.Errorf("check %d got %v", i, got)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Package healthwatch sheds low-priority work before it reaches an overloaded Guard.
+//
+// A Watcher polls QueryGuardHealth in the background for every Guard, feature and priority boost it is asked
+// about, so that Shed is a cheap local lookup. Health is reported per priority boost, so while a Guard is
+// overloaded it is usually only the lower priorities which are shed. A selector starts being shed after a number
+// of HEALTH_OVERLOAD polls in a row and stops after a number of HEALTH_OK polls in a row, so that decisions don't
+// flap when health hovers around the limit. By choice, HEALTH_DOWN never sheds work and doesn't count towards
+// either decision, so that a Guard which is down is treated like a hub which can't be reached: requests are let
+// through, as they are when quota can't be checked.
+package healthwatch
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Defaults for the Watcher options.
+const (
+	DefaultInterval    = time.Second
+	DefaultEnterAfter  = 2
+	DefaultExitAfter   = 3
+	DefaultIdleTimeout = time.Minute
+	DefaultStaleAfter  = 5 * time.Second
+)
+
+// State is what a Watcher knows about one selector's health.
+type State struct {
+	Health   pb.Health // from the last successful poll; HEALTH_UNSPECIFIED before the first
+	Shedding bool
+	Updated  time.Time // of the last successful poll
+	Err      error     // from the last poll, if it failed
+}
+
+// Watcher caches the health of Guards. It is safe for concurrent use.
+type Watcher struct {
+	client      pb.HealthServiceClient
+	apikey      string
+	interval    time.Duration
+	enterAfter  int
+	exitAfter   int
+	idleTimeout time.Duration
+	staleAfter  time.Duration
+	timeout     time.Duration
+	onChange    func(sel lease.Selector, shedding bool)
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type entry struct {
+	sel      lease.Selector
+	state    State
+	streak   int // polls in a row which disagree with the current shedding decision
+	lastUsed time.Time
+	polling  bool
+}
+
+// Option configures a Watcher.
+type Option func(*Watcher)
+
+// WithInterval polls each selector this often.
+func WithInterval(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.interval = d
+	}
+}
+
+// WithHysteresis starts shedding after enter HEALTH_OVERLOAD polls in a row, and stops after exit HEALTH_OK polls in a row.
+func WithHysteresis(enter, exit int) Option {
+	return func(w *Watcher) {
+		w.enterAfter, w.exitAfter = enter, exit
+	}
+}
+
+// WithIdleTimeout stops polling selectors which Shed has not been asked about for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.idleTimeout = d
+	}
+}
+
+// WithStaleAfter stops shedding a selector whose health has not been polled successfully for d,
+// so that work isn't shed on the strength of an old answer while the hub is unreachable.
+func WithStaleAfter(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.staleAfter = d
+	}
+}
+
+// WithChange calls f whenever a selector starts or stops being shed. It must not call back into the Watcher.
+func WithChange(f func(sel lease.Selector, shedding bool)) Option {
+	return func(w *Watcher) {
+		w.onChange = f
+	}
+}
+
+// NewWatcher returns a Watcher which authenticates to the hub on conn with apikey. Close must be called to stop polling.
+func NewWatcher(conn grpc.ClientConnInterface, apikey string, opts ...Option) *Watcher {
+	w := &Watcher{
+		client:      pb.NewHealthServiceClient(conn),
+		apikey:      apikey,
+		interval:    DefaultInterval,
+		enterAfter:  DefaultEnterAfter,
+		exitAfter:   DefaultExitAfter,
+		idleTimeout: DefaultIdleTimeout,
+		staleAfter:  DefaultStaleAfter,
+		timeout:     time.Second,
+		now:         time.Now,
+		entries:     make(map[string]*entry),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	go w.loop()
+	return w
+}
+
+// Shed reports whether work for sel should be shed. It never calls the hub: a selector seen for the first time
+// is not shed, and is polled from then on. sel.Tags should only include the Guard's quota tags.
+func (w *Watcher) Shed(sel lease.Selector) bool {
+	now := w.now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e := w.entry(sel, now)
+	e.lastUsed = now
+	return w.shedding(e, now)
+}
+
+// Watch starts polling sel without waiting for the first call to Shed, so that it is ready in advance.
+func (w *Watcher) Watch(sel lease.Selector) {
+	now := w.now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.entry(sel, now).lastUsed = now
+}
+
+// State returns what is known about sel's health, and false if it is not being watched.
+func (w *Watcher) State(sel lease.Selector) (State, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.entries[sel.Key()]
+	if !ok {
+		return State{}, false
+	}
+	st := e.state
+	st.Shedding = w.shedding(e, w.now())
+	return st, true
+}
+
+// shedding reports whether e's work should be shed now. w.mu must be held.
+func (w *Watcher) shedding(e *entry, now time.Time) bool {
+	return e.state.Shedding && e.state.Health != pb.Health_HEALTH_DOWN && now.Sub(e.state.Updated) <= w.staleAfter
+}
+
+// Close stops polling.
+func (w *Watcher) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+// entry returns the entry for sel, creating it and starting its first poll if needed. w.mu must be held.
+func (w *Watcher) entry(sel lease.Selector, now time.Time) *entry {
+	k := sel.Key()
+	e, ok := w.entries[k]
+	if !ok {
+		e = &entry{sel: sel, lastUsed: now, polling: true}
+		w.entries[k] = e
+		go w.poll(e)
+	}
+	return e
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			w.mu.Lock()
+			for k, e := range w.entries {
+				switch {
+				case now.Sub(e.lastUsed) > w.idleTimeout:
+					if !e.polling {
+						delete(w.entries, k)
+					}
+				case !e.polling:
+					e.polling = true
+					go w.poll(e)
+				}
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// poll queries e's health once and updates its shedding decision.
+func (w *Watcher) poll(e *entry) {
+	req := &pb.QueryGuardHealthRequest{
+		Selector: &pb.GuardFeatureSelector{Environment: e.sel.Environment, GuardName: e.sel.Guard, Tags: e.sel.Tags},
+	}
+	if e.sel.Feature != "" {
+		req.Selector.FeatureName = proto.String(e.sel.Feature)
+	}
+	if e.sel.PriorityBoost != 0 {
+		req.PriorityBoost = proto.Int32(e.sel.PriorityBoost)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", w.apikey)
+	res, err := w.client.QueryGuardHealth(ctx, req)
+
+	w.mu.Lock()
+	e.polling = false
+	e.state.Err = err
+	if err != nil {
+		w.mu.Unlock()
+		return
+	}
+	e.state.Health, e.state.Updated = res.GetHealth(), w.now()
+
+	// Count polls in a row which point the other way, and only change the decision after enough of them.
+	switch {
+	case !e.state.Shedding && e.state.Health == pb.Health_HEALTH_OVERLOAD,
+		e.state.Shedding && e.state.Health == pb.Health_HEALTH_OK:
+		e.streak++
+	case e.state.Health == pb.Health_HEALTH_DOWN:
+		// Leave the streak as it is; DOWN says nothing either way about load.
+	default:
+		e.streak = 0
+	}
+	changed := false
+	if (!e.state.Shedding && e.streak >= w.enterAfter) || (e.state.Shedding && e.streak >= w.exitAfter) {
+		e.state.Shedding, e.streak, changed = !e.state.Shedding, 0, true
+	}
+	shedding := e.state.Shedding
+	w.mu.Unlock()
+
+	if changed && w.onChange != nil {
+		w.onChange(e.sel, shedding)
+	}
+}
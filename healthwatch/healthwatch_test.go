@@ -0,0 +1,128 @@
+package healthwatch
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// healthHub answers QueryGuardHealth with health, or err.
+type healthHub struct {
+	health pb.Health
+	err    error
+}
+
+func (h *healthHub) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	if h.err != nil {
+		return h.err
+	}
+	proto.Merge(reply.(proto.Message), &pb.QueryGuardHealthResponse{Health: h.health})
+	return nil
+}
+
+func (h *healthHub) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	panic("not implemented")
+}
+
+// newTestWatcher returns a Watcher which only polls sel when the test calls poll, and whose clock is *now.
+func newTestWatcher(t *testing.T, hub *healthHub, sel lease.Selector, now *time.Time, opts ...Option) (*Watcher, *entry) {
+	w := NewWatcher(hub, "key", append([]Option{WithInterval(time.Hour)}, opts...)...)
+	t.Cleanup(w.Close)
+	w.now = func() time.Time { return *now }
+	e := &entry{sel: sel, lastUsed: *now}
+	w.entries[sel.Key()] = e
+	return w, e
+}
+
+func TestHysteresis(t *testing.T) {
+	const (
+		ok       = pb.Health_HEALTH_OK
+		overload = pb.Health_HEALTH_OVERLOAD
+		down     = pb.Health_HEALTH_DOWN
+	)
+	tests := []struct {
+		name        string
+		enter, exit int
+		polls       []pb.Health
+		expect      string // whether Shed is true after each poll: S if so, . if not
+		changes     int    // calls to the change function
+	}{
+		{"shed after two overloads", 2, 3, []pb.Health{ok, overload, overload}, "..S", 1},
+		{"overloads must be in a row", 2, 3, []pb.Health{overload, ok, overload, overload}, "...S", 1},
+		{"stop after three OKs", 2, 3, []pb.Health{overload, overload, ok, ok, ok}, ".SSS.", 2},
+		{"OKs must be in a row", 2, 3, []pb.Health{overload, overload, ok, ok, overload, ok, ok, ok}, ".SSSSSS.", 2},
+		{"down doesn't count towards shedding", 2, 3, []pb.Health{overload, down, overload}, "..S", 1},
+		{"down doesn't shed or count towards stopping", 2, 3, []pb.Health{overload, overload, down, ok, ok, ok}, ".S.SS.", 2},
+		{"no hysteresis", 1, 1, []pb.Health{overload, ok, overload}, "S.S", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &healthHub{}
+			now := time.Unix(1000, 0)
+			changes := 0
+			sel := lease.Selector{Environment: "prod", Guard: "g"}
+			w, e := newTestWatcher(t, hub, sel, &now,
+				WithHysteresis(tt.enter, tt.exit),
+				WithChange(func(_ lease.Selector, shedding bool) { changes++ }))
+
+			got := ""
+			for _, h := range tt.polls {
+				hub.health = h
+				w.poll(e)
+				if w.Shed(sel) {
+					got += "S"
+				} else {
+					got += "."
+				}
+			}
+			if got != tt.expect {
+				t.Errorf("shed %s, want %s", got, tt.expect)
+			}
+			if changes != tt.changes {
+				t.Errorf("got %d changes, want %d", changes, tt.changes)
+			}
+		})
+	}
+}
+
+func TestStale(t *testing.T) {
+	steps := []struct {
+		name    string
+		advance time.Duration // before polling
+		health  pb.Health     // if set, polled successfully
+		err     error         // if set, the poll fails
+		expect  bool
+	}{
+		{"overloaded", 0, pb.Health_HEALTH_OVERLOAD, nil, true},
+		{"poll fails", time.Second, 0, errors.New("unavailable"), true},
+		{"last good poll at the limit", 4 * time.Second, 0, nil, true},
+		{"last good poll too old", time.Millisecond, 0, nil, false},
+		{"poll still failing", time.Second, 0, errors.New("unavailable"), false},
+		{"hub back", time.Second, pb.Health_HEALTH_OVERLOAD, nil, true},
+	}
+	hub := &healthHub{}
+	now := time.Unix(1000, 0)
+	sel := lease.Selector{Environment: "prod", Guard: "g"}
+	w, e := newTestWatcher(t, hub, sel, &now, WithHysteresis(1, 1), WithStaleAfter(5*time.Second))
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if step.health != 0 || step.err != nil {
+			hub.health, hub.err = step.health, step.err
+			w.poll(e)
+		}
+		if got := w.Shed(sel); got != step.expect {
+			t.Errorf("%s: shed %v, want %v", step.name, got, step.expect)
+		}
+		st, _ := w.State(sel)
+		if (st.Err != nil) != (hub.err != nil) {
+			t.Errorf("%s: got state error %v", step.name, st.Err)
+		}
+	}
+}
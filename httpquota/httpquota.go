@@ -0,0 +1,156 @@
+// Package httpquota is net/http middleware which admits requests only if Stanza grants them quota.
+//
+// Each request is mapped to a Guard, feature, priority boost, weight and tags by the Extractors in
+// a Config, and a token is requested for it from a lease.Cache or lease.Direct. Requests which are
+// refused quota get a 429 response with a Retry-After header, and requests whose values can't be
+// extracted, such as a weight which isn't a number, get a 400. The decision, including its Quota
+// status, is available to the handler with FromContext.
+package httpquota
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+)
+
+// Extractor derives a value from a request, returning "" if the request has none.
+// Any function can be used as a custom Extractor.
+type Extractor func(r *http.Request) string
+
+// Const always returns v.
+func Const(v string) Extractor {
+	return func(*http.Request) string { return v }
+}
+
+// Header returns the value of the named request header.
+func Header(name string) Extractor {
+	return func(r *http.Request) string { return r.Header.Get(name) }
+}
+
+// Query returns the value of the named query parameter.
+func Query(param string) Extractor {
+	return func(r *http.Request) string { return r.URL.Query().Get(param) }
+}
+
+// PathPrefix maps URL path prefixes to values, returning the value of the longest prefix which matches.
+func PathPrefix(prefixes map[string]string) Extractor {
+	return func(r *http.Request) string {
+		best, value := -1, ""
+		for prefix, v := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) && len(prefix) > best {
+				best, value = len(prefix), v
+			}
+		}
+		return value
+	}
+}
+
+// Defaults for the Config.
+const (
+	DefaultTimeout    = time.Second
+	DefaultRetryAfter = time.Second
+)
+
+// Config says how requests are mapped to quota, and what to do with the decision.
+type Config struct {
+	Environment string
+	Guard       Extractor
+	Feature     Extractor            // optional
+	Tags        map[string]Extractor // tag key to value; tags with no value are left out
+	// PriorityBoost and Weight are optional, and must extract an integer and a number respectively.
+	PriorityBoost Extractor
+	Weight        Extractor
+	// Selector, if set, is a custom mapping used instead of all of the Extractors above.
+	Selector func(r *http.Request) (sel lease.Selector, weight float32, err error)
+
+	// Reporter, if set, reports leased tokens as consumed once the handler has returned.
+	Reporter *lease.Reporter
+	// Timeout bounds how long a request waits for quota. DefaultTimeout if unset.
+	Timeout time.Duration
+	// RetryAfter is sent to refused clients. DefaultRetryAfter if unset.
+	RetryAfter time.Duration
+	// FailClosed refuses requests, with a 503, when quota could not be checked. By default they are let through.
+	FailClosed bool
+	// OnDecision, if set, is called with every decision, for metrics and logging.
+	OnDecision func(r *http.Request, d *lease.Decision)
+}
+
+type contextKey struct{}
+
+// FromContext returns the Decision made for the request with context ctx, or nil.
+func FromContext(ctx context.Context) *lease.Decision {
+	d, _ := ctx.Value(contextKey{}).(*lease.Decision)
+	return d
+}
+
+// New returns middleware which checks every request's quota with tokens.
+func New(tokens lease.Tokens, cfg Config) func(http.Handler) http.Handler {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = DefaultRetryAfter
+	}
+	retryAfter := strconv.Itoa(int(math.Ceil(cfg.RetryAfter.Seconds())))
+	decider := lease.Decider{Tokens: tokens, Timeout: cfg.Timeout, FailClosed: cfg.FailClosed}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sel, weight, err := cfg.selector(r)
+			d := decider.Decide(r.Context(), sel, weight, err)
+			if cfg.OnDecision != nil {
+				cfg.OnDecision(r, d)
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !d.Allowed {
+				w.Header().Set("Retry-After", retryAfter)
+				if d.Quota == pb.Quota_QUOTA_BLOCKED {
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				} else {
+					http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				}
+				return
+			}
+			defer d.Report(cfg.Reporter)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, d)))
+		})
+	}
+}
+
+func (cfg *Config) selector(r *http.Request) (lease.Selector, float32, error) {
+	if cfg.Selector != nil {
+		return cfg.Selector(r)
+	}
+	extract := func(e Extractor) string {
+		if e == nil {
+			return ""
+		}
+		return e(r)
+	}
+	f := lease.Fields{
+		Environment:   cfg.Environment,
+		Guard:         extract(cfg.Guard),
+		Feature:       extract(cfg.Feature),
+		Tags:          make(map[string]string, len(cfg.Tags)),
+		PriorityBoost: extract(cfg.PriorityBoost),
+		Weight:        extract(cfg.Weight),
+	}
+	for key, e := range cfg.Tags {
+		f.Tags[key] = e(r)
+	}
+	sel, weight, err := f.Selector()
+	if err != nil {
+		return sel, 0, fmt.Errorf("%s: %w", r.URL.Path, err)
+	}
+	return sel, weight, nil
+}
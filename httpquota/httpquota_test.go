@@ -0,0 +1,144 @@
+package httpquota
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/lease"
+
+	"google.golang.org/grpc"
+)
+
+// fakeTokens answers every request with grant and err, recording what it was asked for.
+type fakeTokens struct {
+	grant  *lease.Grant
+	err    error
+	sel    lease.Selector
+	weight float32
+	calls  int
+}
+
+func (f *fakeTokens) Get(ctx context.Context, sel lease.Selector, weight float32) (*lease.Grant, error) {
+	f.sel, f.weight = sel, weight
+	f.calls++
+	return f.grant, f.err
+}
+
+// consumedHub counts the tokens reported to SetTokenLeaseConsumed.
+type consumedHub struct {
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (h *consumedHub) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = append(h.tokens, args.(*pb.SetTokenLeaseConsumedRequest).GetTokens()...)
+	return nil
+}
+
+func (h *consumedHub) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	panic("not implemented")
+}
+
+func TestMiddleware(t *testing.T) {
+	granted := &lease.Grant{Granted: true, Token: "t", Weight: 1, Leased: true, Environment: "prod"}
+	tests := []struct {
+		name       string
+		header     map[string]string
+		grant      *lease.Grant
+		err        error
+		failClosed bool
+		expect     int
+		quota      pb.Quota // seen by the handler, if it runs
+	}{
+		{"granted", map[string]string{"X-Guard": "g"}, granted, nil, false, http.StatusOK, pb.Quota_QUOTA_GRANTED},
+		{"refused", map[string]string{"X-Guard": "g"}, &lease.Grant{}, nil, false, http.StatusTooManyRequests, 0},
+		{"report-only", map[string]string{"X-Guard": "g"}, &lease.Grant{Mode: pb.Mode_MODE_REPORT_ONLY}, nil, false, http.StatusOK, pb.Quota_QUOTA_BLOCKED},
+		{"hub error fails open", map[string]string{"X-Guard": "g"}, nil, errors.New("unavailable"), false, http.StatusOK, pb.Quota_QUOTA_ERROR},
+		{"hub error fails closed", map[string]string{"X-Guard": "g"}, nil, errors.New("unavailable"), true, http.StatusServiceUnavailable, 0},
+		{"no guard", nil, granted, nil, false, http.StatusBadRequest, 0},
+		{"bad weight", map[string]string{"X-Guard": "g", "X-Weight": "heavy"}, granted, nil, false, http.StatusBadRequest, 0},
+		{"bad priority boost", map[string]string{"X-Guard": "g", "X-Boost": "1.5"}, granted, nil, false, http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := &fakeTokens{grant: tt.grant, err: tt.err}
+			mw := New(tokens, Config{
+				Environment:   "prod",
+				Guard:         Header("X-Guard"),
+				PriorityBoost: Header("X-Boost"),
+				Weight:        Header("X-Weight"),
+				FailClosed:    tt.failClosed,
+			})
+			var quota pb.Quota
+			h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { quota = FromContext(r.Context()).Quota }))
+			r := httptest.NewRequest("GET", "/search", nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.expect {
+				t.Fatalf("got status %d, want %d", w.Code, tt.expect)
+			}
+			if quota != tt.quota {
+				t.Errorf("handler saw quota %v, want %v", quota, tt.quota)
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+				t.Errorf("got Retry-After %q", w.Header().Get("Retry-After"))
+			}
+			if w.Code == http.StatusBadRequest && tokens.calls > 0 {
+				t.Errorf("asked for quota for a bad request")
+			}
+		})
+	}
+}
+
+func TestSelector(t *testing.T) {
+	tokens := &fakeTokens{grant: &lease.Grant{Granted: true}}
+	mw := New(tokens, Config{
+		Environment:   "prod",
+		Guard:         Const("g"),
+		Feature:       PathPrefix(map[string]string{"/api/": "api", "/api/search": "search"}),
+		Tags:          map[string]Extractor{"customer": Query("customer"), "tier": Header("X-Tier")},
+		PriorityBoost: Header("X-Boost"),
+		Weight:        Header("X-Weight"),
+	})
+	r := httptest.NewRequest("GET", "/api/search/items?customer=c1", nil)
+	r.Header.Set("X-Boost", "-2")
+	r.Header.Set("X-Weight", "2.5")
+	mw(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})).ServeHTTP(httptest.NewRecorder(), r)
+
+	sel := tokens.sel
+	if sel.Environment != "prod" || sel.Guard != "g" || sel.Feature != "search" || sel.PriorityBoost != -2 || tokens.weight != 2.5 {
+		t.Errorf("got selector %+v and weight %v", sel, tokens.weight)
+	}
+	// The tier header is missing, so only the customer tag is sent.
+	if len(sel.Tags) != 1 || sel.Tags[0].GetKey() != "customer" || sel.Tags[0].GetValue() != "c1" {
+		t.Errorf("got tags %v", sel.Tags)
+	}
+}
+
+func TestReportAfterPanic(t *testing.T) {
+	hub := &consumedHub{}
+	reporter := lease.NewReporter(hub, "key", lease.WithFlushInterval(time.Hour))
+	tokens := &fakeTokens{grant: &lease.Grant{Granted: true, Token: "t", Weight: 1, Leased: true, Environment: "prod"}}
+	h := New(tokens, Config{Guard: Const("g"), Reporter: reporter})(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("handler failed")
+	}))
+	func() {
+		defer func() { recover() }()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	reporter.Close(context.Background())
+	if len(hub.tokens) != 1 || hub.tokens[0] != "t" {
+		t.Errorf("got consumed tokens %v, want [t]", hub.tokens)
+	}
+}
@@ -0,0 +1,125 @@
+package hubauth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorize(t *testing.T) {
+	keys := NewKeyStore()
+	keys.Add("prod-key", "prod")
+	keys.Add("admin-key", AnyEnvironment)
+	iss := NewIssuer(keys, []byte("secret"), time.Hour)
+	prodToken, _, err := iss.Issue("prod-key", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := iss.Issue("prod-key", "dev"); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("issuing a token for an environment outside the key's scope: got %v", err)
+	}
+	old := NewIssuer(keys, []byte("secret"), time.Hour)
+	old.now = func() time.Time { return time.Now().Add(-2 * time.Hour) }
+	expired, _, _ := old.Issue("prod-key", "prod")
+
+	tests := []struct {
+		name   string
+		md     metadata.MD
+		env    string
+		expect codes.Code
+	}{
+		{"no credentials", metadata.Pairs(), "prod", codes.Unauthenticated},
+		{"unknown key", metadata.Pairs("x-stanza-key", "nope"), "prod", codes.Unauthenticated},
+		{"key in scope", metadata.Pairs("x-stanza-key", "prod-key"), "prod", codes.OK},
+		{"key out of scope", metadata.Pairs("x-stanza-key", "prod-key"), "dev", codes.PermissionDenied},
+		{"key for any environment", metadata.Pairs("x-stanza-key", "admin-key"), "dev", codes.OK},
+		{"key with no environment", metadata.Pairs("x-stanza-key", "prod-key"), "", codes.OK},
+		{"bearer token", metadata.Pairs("authorization", "Bearer "+prodToken), "prod", codes.OK},
+		{"bearer token out of scope", metadata.Pairs("authorization", "Bearer "+prodToken), "dev", codes.PermissionDenied},
+		{"tampered bearer token", metadata.Pairs("authorization", "Bearer "+prodToken+"x"), "prod", codes.Unauthenticated},
+		{"expired bearer token", metadata.Pairs("authorization", "Bearer "+expired), "prod", codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := iss.Authorize(metadata.NewIncomingContext(context.Background(), tt.md), tt.env)
+			if got := status.Code(err); got != tt.expect {
+				t.Errorf("got %v, want %v", err, tt.expect)
+			}
+		})
+	}
+
+	keys.Remove("prod-key")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+prodToken))
+	if err := iss.Authorize(ctx, "prod"); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("bearer token for a removed key: got %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	keys := NewKeyStore()
+	keys.Add("key", "prod")
+	issued := time.Unix(1000, 0)
+	tests := []struct {
+		name   string
+		age    time.Duration
+		expect codes.Code
+	}{
+		{"new", 0, codes.OK},
+		{"just before expiry", 1500*time.Millisecond - time.Millisecond, codes.OK},
+		{"at expiry", 1500 * time.Millisecond, codes.Unauthenticated},
+		{"after expiry", time.Hour, codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iss := NewIssuer(keys, []byte("secret"), 1500*time.Millisecond)
+			iss.now = func() time.Time { return issued }
+			token, expires, err := iss.Issue("key", "prod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := issued.Add(1500 * time.Millisecond); !expires.Equal(want) {
+				t.Errorf("expires at %v, want %v", expires, want)
+			}
+			iss.now = func() time.Time { return issued.Add(tt.age) }
+			if got := status.Code(iss.Check(token, "prod")); got != tt.expect {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestEnvironments(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  any
+		want []string
+	}{
+		{"top level", &pb.GetBearerTokenRequest{Environment: "a"}, []string{"a"}},
+		{"nested selector", &pb.GetTokenRequest{Selector: &pb.GuardFeatureSelector{Environment: "b"}}, []string{"b"}},
+		{"repeated", &pb.ValidateTokenRequest{Tokens: []*pb.TokenInfo{
+			{Guard: &pb.GuardSelector{Environment: "a"}},
+			{Guard: &pb.GuardSelector{Environment: "b"}},
+			{Guard: &pb.GuardSelector{Environment: "a"}},
+		}}, []string{"a", "b"}},
+		{"none", &pb.GetBearerTokenRequest{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := environments(tt.msg)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Package hubauth authenticates callers of a Stanza hub implementation. API keys, sent in the X-Stanza-Key header,
+// are scoped to environments by a KeyStore. AuthService.GetBearerToken exchanges a key for an expiring bearer token,
+// which is sent as "Authorization: Bearer <token>" and is accepted wherever the key would be.
+//
+// The gRPC interceptors reject calls with no valid credentials with codes.Unauthenticated, and calls for an
+// environment the credentials don't cover with codes.PermissionDenied. For the gateway, HeaderMatcher forwards
+// X-Stanza-Key to the gRPC server, and Middleware turns away HTTP requests with no valid credentials before they
+// reach it.
+package hubauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AnyEnvironment scopes a key to every environment.
+const AnyEnvironment = "*"
+
+// KeyStore holds the API keys which may call the hub, and the environments each may use.
+// Keys are only kept as hashes. It is safe for concurrent use.
+type KeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]map[string]bool // key hash to environments
+}
+
+// NewKeyStore returns an empty KeyStore.
+func NewKeyStore() *KeyStore {
+	return &KeyStore{keys: make(map[string]map[string]bool)}
+}
+
+// KeyFile is the JSON format read by LoadKeys.
+type KeyFile struct {
+	Keys []struct {
+		Key          string   `json:"key"`
+		Environments []string `json:"environments"` // "*" for every environment
+	} `json:"keys"`
+}
+
+// LoadKeys reads a KeyStore from a JSON KeyFile.
+func LoadKeys(path string) (*KeyStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f KeyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	ks := NewKeyStore()
+	for i, k := range f.Keys {
+		if k.Key == "" || len(k.Environments) == 0 {
+			return nil, fmt.Errorf("%s: key %d needs a key and at least one environment", path, i)
+		}
+		ks.Add(k.Key, k.Environments...)
+	}
+	return ks, nil
+}
+
+// Add allows key to use the given environments, on top of any it could already use.
+func (ks *KeyStore) Add(key string, environments ...string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	h := hash(key)
+	if ks.keys[h] == nil {
+		ks.keys[h] = make(map[string]bool)
+	}
+	for _, env := range environments {
+		ks.keys[h][env] = true
+	}
+}
+
+// Remove revokes key, along with any bearer tokens issued for it.
+func (ks *KeyStore) Remove(key string) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	delete(ks.keys, hash(key))
+}
+
+// Check returns nil if key may use environment, or a gRPC status error: Unauthenticated if the key is missing or
+// unknown, and PermissionDenied if it isn't scoped to environment. An empty environment only checks the key.
+func (ks *KeyStore) Check(key, environment string) error {
+	if key == "" {
+		return status.Error(codes.Unauthenticated, "missing API key")
+	}
+	return ks.checkHash(hash(key), environment)
+}
+
+func (ks *KeyStore) checkHash(h, environment string) error {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	envs, ok := ks.keys[h]
+	if !ok {
+		return status.Error(codes.Unauthenticated, "invalid API key")
+	}
+	if environment != "" && !envs[environment] && !envs[AnyEnvironment] {
+		return status.Errorf(codes.PermissionDenied, "API key may not use environment %q", environment)
+	}
+	return nil
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
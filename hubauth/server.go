@@ -0,0 +1,176 @@
+package hubauth
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Header names for credentials, as HTTP headers; gRPC metadata keys are the same in lower case.
+const (
+	KeyHeader    = "X-Stanza-Key"
+	BearerHeader = "Authorization"
+)
+
+// Server implements AuthService.
+type Server struct {
+	pb.UnimplementedAuthServiceServer
+	issuer *Issuer
+}
+
+// NewServer returns an AuthService which issues bearer tokens with iss.
+func NewServer(iss *Issuer) *Server {
+	return &Server{issuer: iss}
+}
+
+// GetBearerToken exchanges the caller's API key for a bearer token for the requested environment.
+func (s *Server) GetBearerToken(ctx context.Context, req *pb.GetBearerTokenRequest) (*pb.GetBearerTokenResponse, error) {
+	token, _, err := s.issuer.Issue(first(metadata.ValueFromIncomingContext(ctx, strings.ToLower(KeyHeader))), req.GetEnvironment())
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetBearerTokenResponse{BearerToken: token}, nil
+}
+
+// Authorize checks the credentials in ctx's incoming metadata against environment, or only checks they are
+// valid if environment is empty. A bearer token is used if there is one, and otherwise the API key.
+func (iss *Issuer) Authorize(ctx context.Context, environment string) error {
+	if token, ok := bearer(first(metadata.ValueFromIncomingContext(ctx, strings.ToLower(BearerHeader)))); ok {
+		return iss.Check(token, environment)
+	}
+	return iss.keys.Check(first(metadata.ValueFromIncomingContext(ctx, strings.ToLower(KeyHeader))), environment)
+}
+
+// authorizeMessage checks the credentials in ctx against every environment named in msg.
+func (iss *Issuer) authorizeMessage(ctx context.Context, msg any) error {
+	envs := environments(msg)
+	if len(envs) == 0 {
+		return iss.Authorize(ctx, "")
+	}
+	for _, env := range envs {
+		if err := iss.Authorize(ctx, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnaryServerInterceptor rejects calls without credentials for the environments in their requests.
+func UnaryServerInterceptor(iss *Issuer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := iss.authorizeMessage(ctx, req); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rejects streams without valid credentials, and fails them as soon as a message
+// arrives for an environment the credentials don't cover.
+func StreamServerInterceptor(iss *Issuer) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := iss.Authorize(ss.Context(), ""); err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, issuer: iss})
+	}
+}
+
+// serverStream checks every message received on a grpc.ServerStream.
+type serverStream struct {
+	grpc.ServerStream
+	issuer *Issuer
+}
+
+func (s *serverStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return s.issuer.authorizeMessage(s.Context(), m)
+}
+
+// HeaderMatcher is a runtime.HeaderMatcherFunc for the gateway's ServeMux which forwards X-Stanza-Key to the gRPC
+// server, where the interceptors check it. The gateway already forwards Authorization.
+func HeaderMatcher(key string) (string, bool) {
+	if textproto.CanonicalMIMEHeaderKey(key) == KeyHeader {
+		return strings.ToLower(KeyHeader), true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// Middleware turns away gateway requests with no valid credentials. Environments are in request bodies, so they
+// are checked by the interceptors on the gRPC server the gateway forwards to.
+func Middleware(iss *Issuer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var err error
+			if token, ok := bearer(r.Header.Get(BearerHeader)); ok {
+				err = iss.Check(token, "")
+			} else {
+				err = iss.keys.Check(r.Header.Get(KeyHeader), "")
+			}
+			if err != nil {
+				code := runtime.HTTPStatusFromCode(status.Code(err))
+				http.Error(w, status.Convert(err).Message(), code)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// environments returns every environment field set anywhere in msg, such as in its selectors.
+func environments(msg any) []string {
+	m, ok := msg.(proto.Message)
+	if !ok {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var envs []string
+	var walk func(protoreflect.Message)
+	walk = func(m protoreflect.Message) {
+		m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			switch {
+			case fd.Name() == "environment" && fd.Kind() == protoreflect.StringKind && !fd.IsList():
+				if env := v.String(); env != "" && !seen[env] {
+					seen[env] = true
+					envs = append(envs, env)
+				}
+			case fd.Kind() == protoreflect.MessageKind && fd.IsList():
+				for i := 0; i < v.List().Len(); i++ {
+					walk(v.List().Get(i).Message())
+				}
+			case fd.Kind() == protoreflect.MessageKind && !fd.IsMap():
+				walk(v.Message())
+			}
+			return true
+		})
+	}
+	walk(m.ProtoReflect())
+	return envs
+}
+
+func bearer(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+func first(v []string) string {
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
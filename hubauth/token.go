@@ -0,0 +1,94 @@
+package hubauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultTokenTTL is how long bearer tokens last if NewIssuer is given no TTL.
+const DefaultTokenTTL = time.Hour
+
+// Issuer signs and verifies bearer tokens. Each token is bound to the key it was issued for and to one environment,
+// so it stops working if the key is removed from the KeyStore.
+type Issuer struct {
+	keys   *KeyStore
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// claims is the payload of a bearer token.
+type claims struct {
+	KeyHash     string `json:"kh"`
+	Environment string `json:"env"`
+	Expires     int64  `json:"exp_ms"` // Unix milliseconds
+}
+
+// NewIssuer returns an Issuer for keys which signs tokens with secret, or with a random secret if it is empty,
+// in which case tokens don't survive a restart.
+func NewIssuer(keys *KeyStore, secret []byte, ttl time.Duration) *Issuer {
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(err)
+		}
+	}
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	return &Issuer{keys: keys, secret: secret, ttl: ttl, now: time.Now}
+}
+
+// Issue returns a bearer token for key in environment, after checking the key may use it.
+func (iss *Issuer) Issue(key, environment string) (token string, expires time.Time, err error) {
+	if environment == "" {
+		return "", time.Time{}, status.Error(codes.InvalidArgument, "environment is required")
+	}
+	if err := iss.keys.Check(key, environment); err != nil {
+		return "", time.Time{}, err
+	}
+	expires = iss.now().Add(iss.ttl)
+	payload, err := json.Marshal(claims{KeyHash: hash(key), Environment: environment, Expires: expires.UnixMilli()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + iss.sign(body), expires, nil
+}
+
+// Check returns nil if token is valid and may use environment, with the same errors as KeyStore.Check.
+func (iss *Issuer) Check(token, environment string) error {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(iss.sign(body))) {
+		return status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	var c claims
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	if !iss.now().Before(time.UnixMilli(c.Expires)) {
+		return status.Error(codes.Unauthenticated, "bearer token expired")
+	}
+	if environment != "" && environment != c.Environment {
+		return status.Errorf(codes.PermissionDenied, "bearer token may not use environment %q", environment)
+	}
+	return iss.keys.checkHash(c.KeyHash, c.Environment)
+}
+
+func (iss *Issuer) sign(body string) string {
+	mac := hmac.New(sha256.New, iss.secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
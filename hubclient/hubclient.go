@@ -0,0 +1,163 @@
+// Package hubclient holds the connection settings shared by the command line tools: the hub address,
+// TLS mode and API key, and the default Guard and environment. Settings are resolved from command line
+// flags, then the STANZA_* environment variables, then a named profile (see Config).
+package hubclient
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultHub is the hub used when no other address is configured.
+const DefaultHub = "hub.dev.getstanza.dev:9020" // TODO: hub.demo.getstanza.io:9020 when deployed to demo.
+
+// Environment variables which override profile settings.
+const (
+	EnvAPIKey      = "STANZA_API_KEY"
+	EnvHub         = "STANZA_HUB"
+	EnvEnvironment = "STANZA_ENVIRONMENT"
+	EnvProfile     = "STANZA_PROFILE" // selects the profile if -profile is not given
+	EnvConfig      = "STANZA_CONFIG"  // overrides the path of the profiles file
+)
+
+// Flags are the connection settings shared by every command. Fields left empty are filled in by Resolve.
+type Flags struct {
+	Profile     string
+	Hub         string
+	Insecure    bool
+	APIKey      Secret
+	Guard       string
+	Environment string
+
+	fs                 *flag.FlagSet
+	insecureSet        bool   // Insecure was given explicitly, so the profile must not override it
+	keySource          string // where APIKey came from, for display
+	builtinGuard       bool   // Guard came from the built-in demo profile, so Default may replace it
+	builtinEnvironment bool   // likewise for Environment
+}
+
+// Register adds the connection flags to fs.
+func (f *Flags) Register(fs *flag.FlagSet) {
+	f.fs = fs
+	fs.StringVar(&f.Profile, "profile", "", "Profile to load settings from. Defaults to $"+EnvProfile+", then the profiles file's default_profile, then \""+DemoProfile+"\".")
+	fs.StringVar(&f.Hub, "hub", "", "The hub address host:port to issue queries against. Defaults to $"+EnvHub+", then the profile's hub.")
+	fs.BoolVar(&f.Insecure, "hub_insecure", false, "Skip Hub TLS validation (for local development only).")
+	fs.Var(&f.APIKey, "apikey", "The Stanza API key to authenticate with. Defaults to $"+EnvAPIKey+", then the profile's apikey.")
+}
+
+// RegisterGuard adds -guard and -environment flags to fs, for commands which work against a single Guard.
+func (f *Flags) RegisterGuard(fs *flag.FlagSet) {
+	fs.StringVar(&f.Guard, "guard", "", "The Guard to use. Defaults to the profile's guard.")
+	fs.StringVar(&f.Environment, "environment", "", "The environment of the Guard. Defaults to $"+EnvEnvironment+", then the profile's environment.")
+}
+
+// Resolve fills in every setting which was not given from the environment and then the selected profile,
+// loading the profiles file from DefaultConfigPath. It must be called after the flags have been parsed.
+func (f *Flags) Resolve() error {
+	cfg, err := LoadConfig(DefaultConfigPath())
+	if err != nil && !(os.IsNotExist(err) && os.Getenv(EnvConfig) == "") {
+		return err
+	}
+	return f.ResolveWith(cfg)
+}
+
+// ResolveWith is Resolve with an already loaded Config, which may be nil.
+func (f *Flags) ResolveWith(cfg *Config) error {
+	if f.fs != nil {
+		f.fs.Visit(func(fl *flag.Flag) {
+			if fl.Name == "hub_insecure" {
+				f.insecureSet = true
+			}
+		})
+	} else {
+		f.insecureSet = f.Insecure
+	}
+
+	name, p, err := cfg.Select(or(f.Profile, os.Getenv(EnvProfile)))
+	if err != nil {
+		return err
+	}
+	f.Profile = name
+
+	f.Hub = or(f.Hub, os.Getenv(EnvHub), p.Hub, DefaultHub)
+	if !f.insecureSet {
+		f.Insecure = p.Insecure
+	}
+	f.builtinGuard = p == demoProfile && f.Guard == ""
+	f.Guard = or(f.Guard, p.Guard)
+	f.builtinEnvironment = p == demoProfile && or(f.Environment, os.Getenv(EnvEnvironment)) == ""
+	f.Environment = or(f.Environment, os.Getenv(EnvEnvironment), p.Environment)
+
+	switch {
+	case f.APIKey != "":
+		f.keySource = "flag"
+	case os.Getenv(EnvAPIKey) != "":
+		f.APIKey, f.keySource = Secret(os.Getenv(EnvAPIKey)), "$"+EnvAPIKey
+	case p == demoProfile && f.Hub != DefaultHub:
+		// The demo key is only for the demo hub, and shouldn't be handed to whichever hub -hub points at.
+		return fmt.Errorf("no API key for hub %s: set -apikey, $%s or an apikey in a profile; the demo key is only sent to %s", f.Hub, EnvAPIKey, DefaultHub)
+	case p.APIKey != nil:
+		key, err := p.APIKey.Load()
+		if err != nil {
+			return fmt.Errorf("profile %q: apikey: %w", name, err)
+		}
+		f.APIKey, f.keySource = key, fmt.Sprintf("profile %q (%s)", name, p.APIKey)
+	default:
+		return fmt.Errorf("no API key: set -apikey, $%s or an apikey in profile %q", EnvAPIKey, name)
+	}
+	return nil
+}
+
+// Default sets Guard and Environment to guard and environment, if they are not empty, where Resolve did not find
+// them in a flag, the environment or a profile from the profiles file. The built-in demo profile's Guard and
+// environment are only those of the demo scenario, so they give way. It must be called after Resolve.
+func (f *Flags) Default(guard, environment string) {
+	if guard != "" && (f.Guard == "" || f.builtinGuard) {
+		f.Guard, f.builtinGuard = guard, false
+	}
+	if environment != "" && (f.Environment == "" || f.builtinEnvironment) {
+		f.Environment, f.builtinEnvironment = environment, false
+	}
+}
+
+// String describes the settings, with the API key redacted.
+func (f *Flags) String() string {
+	tls := "TLS"
+	if f.Insecure {
+		tls = "insecure"
+	}
+	return fmt.Sprintf("hub %s (%s), profile %q, apikey %s from %s", f.Hub, tls, f.Profile, f.APIKey, f.keySource)
+}
+
+// Dial connects to the hub.
+func (f *Flags) Dial() (*grpc.ClientConn, error) {
+	config := &tls.Config{} // use default system CA
+	creds := credentials.NewTLS(config)
+	if f.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	return grpc.Dial(f.Hub, grpc.WithTransportCredentials(creds))
+}
+
+// Context returns ctx with the API key attached as outgoing metadata.
+func (f *Flags) Context(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", f.APIKey.Reveal())
+}
+
+// or returns the first non-empty string.
+func or(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,166 @@
+package hubclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DemoProfile is the built-in profile for the public demo Guard. It is used when no other profile is selected,
+// and may be replaced by a profile of the same name in the profiles file. Its API key is only used with DefaultHub.
+const DemoProfile = "demo"
+
+var demoProfile = &Profile{
+	Hub:         DefaultHub,
+	APIKey:      &KeySource{Value: "sb-demo-apikey"},
+	Guard:       "Stream Balancer Quota",
+	Environment: "sb_quota",
+}
+
+// Config is a profiles file, for example:
+//
+//	{
+//	  "default_profile": "dev",
+//	  "profiles": {
+//	    "dev": {"hub": "localhost:9020", "insecure": true, "apikey": {"env": "DEV_STANZA_KEY"}, "guard": "Stream Balancer Quota", "environment": "dev"},
+//	    "prod": {"hub": "hub.getstanza.io:9020", "apikey": {"command": "pass show stanza/prod"}, "environment": "prod"}
+//	  }
+//	}
+type Config struct {
+	DefaultProfile string              `json:"default_profile"`
+	Profiles       map[string]*Profile `json:"profiles"`
+}
+
+// Profile is a named set of connection settings.
+type Profile struct {
+	Hub         string     `json:"hub"`
+	Insecure    bool       `json:"insecure"`
+	APIKey      *KeySource `json:"apikey"`
+	Guard       string     `json:"guard"`
+	Environment string     `json:"environment"`
+}
+
+// KeySource says where to read an API key from. Exactly one field should be set.
+type KeySource struct {
+	File    string `json:"file"`    // read from this file; a leading ~/ is the home directory
+	Env     string `json:"env"`     // read from this environment variable
+	Command string `json:"command"` // the output of this shell command, such as a password manager lookup
+	Value   Secret `json:"value"`   // inline; only for keys which are not secret, such as the demo key
+}
+
+// DefaultConfigPath returns $STANZA_CONFIG, or profiles.json in the user's stanza config directory.
+func DefaultConfigPath() string {
+	if path := os.Getenv(EnvConfig); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "stanza", "profiles.json")
+}
+
+// LoadConfig reads a profiles file.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Select returns the named profile, or the default one if name is empty. cfg may be nil.
+func (cfg *Config) Select(name string) (string, *Profile, error) {
+	if name == "" && cfg != nil {
+		name = cfg.DefaultProfile
+	}
+	if name == "" {
+		name = DemoProfile
+	}
+	if cfg != nil {
+		if p, ok := cfg.Profiles[name]; ok {
+			return name, p, nil
+		}
+	}
+	if name == DemoProfile {
+		return name, demoProfile, nil
+	}
+	return "", nil, fmt.Errorf("unknown profile %q", name)
+}
+
+// Names returns the names of every profile, including the built-in demo profile, sorted.
+func (cfg *Config) Names() []string {
+	names := []string{DemoProfile}
+	if cfg != nil {
+		for name := range cfg.Profiles {
+			if name != DemoProfile {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Load reads the key.
+func (k *KeySource) Load() (Secret, error) {
+	switch {
+	case k.File != "":
+		path := k.File
+		if rest, ok := strings.CutPrefix(path, "~/"); ok {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			path = filepath.Join(home, rest)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return Secret(strings.TrimSpace(string(data))), nil
+	case k.Env != "":
+		v := os.Getenv(k.Env)
+		if v == "" {
+			return "", fmt.Errorf("$%s is not set", k.Env)
+		}
+		return Secret(v), nil
+	case k.Command != "":
+		// Stderr is left attached to the terminal so prompts work, and the output is never
+		// included in errors as it would contain the key.
+		cmd := exec.Command("sh", "-c", k.Command)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command %q: %v", k.Command, err)
+		}
+		return Secret(strings.TrimSpace(string(out))), nil
+	case k.Value != "":
+		return k.Value, nil
+	}
+	return "", fmt.Errorf("no file, env, command or value set")
+}
+
+// String describes where the key is read from, without revealing it.
+func (k *KeySource) String() string {
+	switch {
+	case k.File != "":
+		return "file " + k.File
+	case k.Env != "":
+		return "$" + k.Env
+	case k.Command != "":
+		return "command"
+	}
+	return "inline value"
+}
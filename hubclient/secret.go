@@ -0,0 +1,50 @@
+package hubclient
+
+import "fmt"
+
+// Secret is a credential such as an API key. It is redacted whenever it is formatted or marshalled,
+// so it can't leak into logs or output by accident; use Reveal for the actual value.
+type Secret string
+
+// Reveal returns the secret itself.
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// String returns the first few characters of the secret followed by asterisks.
+func (s Secret) String() string {
+	return Redact(string(s))
+}
+
+// GoString redacts the secret for %#v.
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+// MarshalText redacts the secret when it is marshalled, for instance as JSON.
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText sets the secret, as MarshalText would otherwise stop it being unmarshalled.
+func (s *Secret) UnmarshalText(text []byte) error {
+	*s = Secret(text)
+	return nil
+}
+
+// Set implements flag.Value.
+func (s *Secret) Set(v string) error {
+	*s = Secret(v)
+	return nil
+}
+
+// Redact returns enough of s to tell keys apart, hiding the rest.
+func Redact(s string) string {
+	switch {
+	case s == "":
+		return ""
+	case len(s) < 12:
+		return "****"
+	}
+	return s[:4] + "****"
+}
@@ -0,0 +1,144 @@
+// Package hubhealth derives per-priority Guard health for a locally run hub from the utilization of each Guard's
+// streams and token buckets, and serves it from HealthService.QueryGuardHealth.
+//
+// The hub reports each Guard's utilization to a Tracker as it changes. A priority is HEALTH_OVERLOAD once
+// utilization reaches its threshold, which rises with priority so that low-priority callers see OVERLOAD before
+// high-priority ones, and stays so until utilization falls a hysteresis margin below it, so health doesn't flap
+// around the threshold. A Guard whose utilization hasn't been reported for a while is HEALTH_DOWN.
+package hubhealth
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Defaults for the Options.
+const (
+	DefaultOverloadAt   = 0.8
+	DefaultPriorityStep = 0.05
+	DefaultHysteresis   = 0.05
+	DefaultStaleAfter   = 30 * time.Second
+)
+
+// Utilization is the fraction of a Guard's capacity in use, where 1 is all of it.
+type Utilization struct {
+	Streams float64 // of the weight streams may be allocated
+	Tokens  float64 // of the token bucket
+}
+
+// Tracker holds the health of every Guard. It is safe for concurrent use.
+type Tracker struct {
+	overloadAt   float64
+	priorityStep float64
+	hysteresis   float64
+	staleAfter   time.Duration
+	now          func() time.Time
+
+	mu     sync.Mutex
+	guards map[string]*guard
+}
+
+// guard is a Guard's utilization, and which priorities are overloaded.
+type guard struct {
+	utilization float64
+	reported    time.Time
+	overloaded  map[int32]bool // for each priority seen so far
+}
+
+// Option configures a Tracker.
+type Option func(*Tracker)
+
+// WithThresholds makes priority 0 overloaded at utilization overloadAt, and each priority above or below it at
+// step more or less, up to 1.
+func WithThresholds(overloadAt, step float64) Option {
+	return func(t *Tracker) {
+		t.overloadAt, t.priorityStep = overloadAt, step
+	}
+}
+
+// WithHysteresis keeps a priority overloaded until utilization falls margin below its threshold.
+func WithHysteresis(margin float64) Option {
+	return func(t *Tracker) {
+		t.hysteresis = margin
+	}
+}
+
+// WithStaleAfter makes a Guard HEALTH_DOWN if its utilization hasn't been reported for d.
+func WithStaleAfter(d time.Duration) Option {
+	return func(t *Tracker) {
+		t.staleAfter = d
+	}
+}
+
+// NewTracker returns a Tracker with no Guards.
+func NewTracker(opts ...Option) *Tracker {
+	t := &Tracker{
+		overloadAt:   DefaultOverloadAt,
+		priorityStep: DefaultPriorityStep,
+		hysteresis:   DefaultHysteresis,
+		staleAfter:   DefaultStaleAfter,
+		now:          time.Now,
+		guards:       make(map[string]*guard),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Report sets a Guard's utilization, which is the greater of its stream and token bucket utilization.
+func (t *Tracker) Report(environment, guardName string, u Utilization) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := key(environment, guardName)
+	g := t.guards[k]
+	if g == nil {
+		g = &guard{overloaded: make(map[int32]bool)}
+		t.guards[k] = g
+	}
+	g.utilization, g.reported = max(u.Streams, u.Tokens), t.now()
+	for p := range g.overloaded {
+		t.update(g, p)
+	}
+}
+
+// Health returns a Guard's health for requests with the given priority, with any boost applied, and false if the
+// Guard's utilization has never been reported.
+func (t *Tracker) Health(environment, guardName string, priority int32) (pb.Health, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	g := t.guards[key(environment, guardName)]
+	if g == nil {
+		return pb.Health_HEALTH_UNSPECIFIED, false
+	}
+	if t.now().Sub(g.reported) >= t.staleAfter {
+		return pb.Health_HEALTH_DOWN, true
+	}
+	if _, ok := g.overloaded[priority]; !ok {
+		t.update(g, priority)
+	}
+	if g.overloaded[priority] {
+		return pb.Health_HEALTH_OVERLOAD, true
+	}
+	return pb.Health_HEALTH_OK, true
+}
+
+// update sets whether a priority is overloaded at the Guard's utilization. t.mu must be held.
+func (t *Tracker) update(g *guard, priority int32) {
+	threshold := min(t.overloadAt+float64(priority)*t.priorityStep, 1)
+	overloaded := g.overloaded[priority]
+	switch {
+	case g.utilization >= threshold:
+		overloaded = true
+	case g.utilization < threshold-t.hysteresis:
+		overloaded = false
+	}
+	g.overloaded[priority] = overloaded
+}
+
+func key(environment, guardName string) string {
+	return strconv.Quote(environment) + "," + strconv.Quote(guardName)
+}
@@ -0,0 +1,90 @@
+package hubhealth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHealth(t *testing.T) {
+	const (
+		ok       = pb.Health_HEALTH_OK
+		overload = pb.Health_HEALTH_OVERLOAD
+		down     = pb.Health_HEALTH_DOWN
+	)
+	// With the default thresholds, priority -2 is overloaded at 0.7, 0 at 0.8 and 4 at 1, and each clears 0.05 lower.
+	priorities := []int32{-2, 0, 4}
+	steps := []struct {
+		name    string
+		u       Utilization
+		advance time.Duration // after reporting u
+		expect  []pb.Health   // for each priority
+	}{
+		{"idle", Utilization{Streams: 0.5}, 0, []pb.Health{ok, ok, ok}},
+		{"low priority overloaded first", Utilization{Streams: 0.72}, 0, []pb.Health{overload, ok, ok}},
+		{"at the threshold", Utilization{Tokens: 0.8}, 0, []pb.Health{overload, overload, ok}},
+		{"within the hysteresis margin", Utilization{Tokens: 0.76}, 0, []pb.Health{overload, overload, ok}},
+		{"below the margin", Utilization{Tokens: 0.74}, 0, []pb.Health{overload, ok, ok}},
+		{"token bucket full", Utilization{Streams: 0.2, Tokens: 1}, 0, []pb.Health{overload, overload, overload}},
+		{"streams full", Utilization{Streams: 1.2, Tokens: 0.1}, 0, []pb.Health{overload, overload, overload}},
+		{"recovered", Utilization{Streams: 0.3}, 0, []pb.Health{ok, ok, ok}},
+		{"no longer reported", Utilization{Streams: 0.3}, DefaultStaleAfter, []pb.Health{down, down, down}},
+	}
+	tr := NewTracker()
+	now := time.Unix(1000, 0)
+	tr.now = func() time.Time { return now }
+	for _, step := range steps {
+		tr.Report("prod", "g", step.u)
+		now = now.Add(step.advance)
+		for i, p := range priorities {
+			if got, _ := tr.Health("prod", "g", p); got != step.expect[i] {
+				t.Errorf("%s: priority %d: got %v, want %v", step.name, p, got, step.expect[i])
+			}
+		}
+	}
+	if _, found := tr.Health("prod", "other", 0); found {
+		t.Errorf("found health for a Guard which was never reported")
+	}
+}
+
+func TestQueryGuardHealth(t *testing.T) {
+	tr := NewTracker()
+	tr.Report("prod", "g", Utilization{Streams: 0.85})
+	featurePriority := func(sel *pb.GuardFeatureSelector) int32 {
+		if sel.GetFeatureName() == "checkout" {
+			return 4
+		}
+		return 0
+	}
+	tests := []struct {
+		name   string
+		req    *pb.QueryGuardHealthRequest
+		expect pb.Health
+		code   codes.Code
+	}{
+		{"low priority feature", &pb.QueryGuardHealthRequest{Selector: &pb.GuardFeatureSelector{Environment: "prod", GuardName: "g", FeatureName: proto.String("search")}}, pb.Health_HEALTH_OVERLOAD, codes.OK},
+		{"high priority feature", &pb.QueryGuardHealthRequest{Selector: &pb.GuardFeatureSelector{Environment: "prod", GuardName: "g", FeatureName: proto.String("checkout")}}, pb.Health_HEALTH_OK, codes.OK},
+		{"boosted", &pb.QueryGuardHealthRequest{Selector: &pb.GuardFeatureSelector{Environment: "prod", GuardName: "g", FeatureName: proto.String("search")}, PriorityBoost: proto.Int32(2)}, pb.Health_HEALTH_OK, codes.OK},
+		{"negative boost", &pb.QueryGuardHealthRequest{Selector: &pb.GuardFeatureSelector{Environment: "prod", GuardName: "g", FeatureName: proto.String("checkout")}, PriorityBoost: proto.Int32(-4)}, pb.Health_HEALTH_OVERLOAD, codes.OK},
+		{"unknown guard", &pb.QueryGuardHealthRequest{Selector: &pb.GuardFeatureSelector{Environment: "prod", GuardName: "other"}}, 0, codes.NotFound},
+		{"no guard", &pb.QueryGuardHealthRequest{Selector: &pb.GuardFeatureSelector{Environment: "prod"}}, 0, codes.InvalidArgument},
+	}
+	s := NewServer(tr, featurePriority)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.QueryGuardHealth(context.Background(), tt.req)
+			if got := status.Code(err); got != tt.code {
+				t.Fatalf("got %v, want %v", err, tt.code)
+			}
+			if got := resp.GetHealth(); got != tt.expect {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package hubhealth
+
+import (
+	"context"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Server implements HealthService.
+type Server struct {
+	pb.UnimplementedHealthServiceServer
+	tracker  *Tracker
+	priority func(*pb.GuardFeatureSelector) int32
+}
+
+// NewServer returns a HealthService which answers from t. priority returns the priority of the feature a query
+// selects, to which the query's priority boost is added; if it is nil, every feature has priority 0.
+func NewServer(t *Tracker, priority func(*pb.GuardFeatureSelector) int32) *Server {
+	return &Server{tracker: t, priority: priority}
+}
+
+// QueryGuardHealth returns the health of the selected Guard for the feature's priority with the boost applied.
+// It fails with codes.NotFound for a Guard whose utilization has never been reported.
+func (s *Server) QueryGuardHealth(ctx context.Context, req *pb.QueryGuardHealthRequest) (*pb.QueryGuardHealthResponse, error) {
+	sel := req.GetSelector()
+	if sel.GetEnvironment() == "" || sel.GetGuardName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "selector needs an environment and a guard name")
+	}
+	priority := req.GetPriorityBoost()
+	if s.priority != nil {
+		priority += s.priority(sel)
+	}
+	health, ok := s.tracker.Health(sel.GetEnvironment(), sel.GetGuardName(), priority)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no health for guard %q in environment %q", sel.GetGuardName(), sel.GetEnvironment())
+	}
+	return &pb.QueryGuardHealthResponse{Health: health}, nil
+}
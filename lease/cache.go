@@ -0,0 +1,380 @@
+// Package lease caches quota token leases, so that most requests can be admitted locally
+// without a round trip to the hub.
+//
+// A Cache keeps a pool of leases for every Selector it is asked about. Requests take a lease
+// from the pool; the pool is refilled in the background when it runs low or its leases are
+// about to expire, and when it is empty the Cache falls back to a synchronous GetToken call.
+// Leases handed out must be reported back to the hub once used, which a Reporter does in batches.
+//
+// A Decider turns a request's Selector into a Decision on whether to admit it, for middleware such as
+// httpquota and grpcquota, which find the Selector from a request's Fields.
+package lease
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Selector identifies a pool of leases.
+type Selector struct {
+	Environment   string
+	Guard         string
+	Feature       string
+	PriorityBoost int32
+	// Tags should only include the Guard's quota tags, as returned by GetGuardConfig.
+	Tags []*pb.Tag
+}
+
+// Key returns a string which is the same for Selectors which are equal, whatever the order of their tags,
+// and different otherwise. Names are quoted, so separators in them can't make two Selectors collide.
+func (s Selector) Key() string {
+	tags := make([]string, 0, len(s.Tags))
+	for _, t := range s.Tags {
+		tags = append(tags, strconv.Quote(t.GetKey())+"="+strconv.Quote(t.GetValue()))
+	}
+	sort.Strings(tags)
+	return strings.Join(append([]string{strconv.Quote(s.Environment), strconv.Quote(s.Guard), strconv.Quote(s.Feature), strconv.Itoa(int(s.PriorityBoost))}, tags...), ",")
+}
+
+func (s Selector) featureSelector() *pb.GuardFeatureSelector {
+	sel := &pb.GuardFeatureSelector{Environment: s.Environment, GuardName: s.Guard, Tags: s.Tags}
+	if s.Feature != "" {
+		sel.FeatureName = proto.String(s.Feature)
+	}
+	return sel
+}
+
+// Grant is the outcome of a request for quota.
+type Grant struct {
+	Granted bool
+	Token   string
+	Reason  pb.Reason
+	Mode    pb.Mode
+	Weight  float32 // the weight the token was granted for
+	// Leased is true if the token came from a cached lease rather than a GetToken call.
+	// Leased tokens must be reported as consumed, with Reporter.Report.
+	Leased      bool
+	Environment string
+}
+
+// Stats counts how requests were served.
+type Stats struct {
+	Leased     int // requests served from a cached lease
+	Fallbacks  int // requests which fell back to GetToken
+	Refills    int // GetTokenLease calls
+	Expired    int // leases dropped unused because they expired
+	RefillErrs int // failed or denied GetTokenLease calls
+}
+
+// Defaults for the Cache options.
+const (
+	DefaultRefillAhead = 500 * time.Millisecond
+	DefaultLowWater    = 1
+	DefaultIdleTimeout = 30 * time.Second
+	DefaultBackoff     = time.Second
+)
+
+// Cache hands out quota tokens from cached leases. It is safe for concurrent use.
+type Cache struct {
+	client      pb.QuotaServiceClient
+	apikey      string
+	clientID    string
+	refillAhead time.Duration
+	lowWater    int
+	idleTimeout time.Duration
+	backoff     time.Duration
+	timeout     time.Duration
+	direct      *Direct // for requests no cached lease can serve
+
+	mu    sync.Mutex
+	pools map[string]*pool
+	stats Stats
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Option configures a Cache.
+type Option func(*Cache)
+
+// WithClientID sets the client ID sent with every quota request, which lets the hub size batches of leases.
+// It should be stable for the lifetime of the process.
+func WithClientID(id string) Option {
+	return func(c *Cache) {
+		c.clientID = id
+	}
+}
+
+// WithRefillAhead refills a pool when its soonest lease expires within d.
+func WithRefillAhead(d time.Duration) Option {
+	return func(c *Cache) {
+		c.refillAhead = d
+	}
+}
+
+// WithLowWater refills a pool when it holds n or fewer leases.
+func WithLowWater(n int) Option {
+	return func(c *Cache) {
+		c.lowWater = n
+	}
+}
+
+// WithIdleTimeout stops refilling pools which have not been used for d, so that idle selectors don't waste quota.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(c *Cache) {
+		c.idleTimeout = d
+	}
+}
+
+// WithBackoff waits d before asking for leases again after GetTokenLease failed or was denied.
+func WithBackoff(d time.Duration) Option {
+	return func(c *Cache) {
+		c.backoff = d
+	}
+}
+
+// NewCache returns a Cache which authenticates to the hub on conn with apikey.
+// Close must be called to stop its background refills.
+func NewCache(conn grpc.ClientConnInterface, apikey string, opts ...Option) *Cache {
+	c := &Cache{
+		client:      pb.NewQuotaServiceClient(conn),
+		apikey:      apikey,
+		refillAhead: DefaultRefillAhead,
+		lowWater:    DefaultLowWater,
+		idleTimeout: DefaultIdleTimeout,
+		backoff:     DefaultBackoff,
+		timeout:     5 * time.Second,
+		pools:       make(map[string]*pool),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.direct = &Direct{client: c.client, apikey: c.apikey, clientID: c.clientID}
+	go c.loop()
+	return c
+}
+
+// pool is the leases held for one Selector.
+type pool struct {
+	sel       Selector
+	leases    []*held // sorted by expiry, soonest first
+	weight    float32 // largest weight requested, used as the default weight of new leases
+	lastUsed  time.Time
+	refilling bool
+	retryAt   time.Time // no refills before this, after a failure or denial
+}
+
+type held struct {
+	lease   *pb.TokenLease
+	expires time.Time
+}
+
+// Get returns a token for a request of the given weight, taking it from a cached lease if one
+// matches the selector's feature and priority boost and covers the weight, and otherwise calling GetToken.
+// A weight of zero is treated as 1.
+func (c *Cache) Get(ctx context.Context, sel Selector, weight float32) (*Grant, error) {
+	if weight <= 0 {
+		weight = 1
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	p := c.pool(sel)
+	p.lastUsed = now
+	if weight > p.weight {
+		p.weight = weight
+	}
+	c.expire(p, now)
+	h := p.take(sel, weight)
+	c.maybeRefill(p, now)
+	if h != nil {
+		c.stats.Leased++
+	} else {
+		c.stats.Fallbacks++
+	}
+	c.mu.Unlock()
+
+	if h != nil {
+		return &Grant{
+			Granted:     true,
+			Token:       h.lease.GetToken(),
+			Reason:      h.lease.GetReason(),
+			Mode:        h.lease.GetMode(),
+			Weight:      h.lease.GetWeight(),
+			Leased:      true,
+			Environment: sel.Environment,
+		}, nil
+	}
+	return c.direct.Get(ctx, sel, weight)
+}
+
+// Prefetch synchronously fills the pool for sel with leases of the given default weight,
+// so that the first requests for it don't have to fall back to GetToken. If the pool is already being
+// refilled, it returns straight away rather than asking for more leases.
+func (c *Cache) Prefetch(ctx context.Context, sel Selector, weight float32) error {
+	c.mu.Lock()
+	p := c.pool(sel)
+	p.lastUsed = time.Now()
+	if weight > p.weight {
+		p.weight = weight
+	}
+	if p.refilling {
+		c.mu.Unlock()
+		return nil
+	}
+	p.refilling = true
+	c.mu.Unlock()
+	return c.refill(ctx, p)
+}
+
+// Stats returns counts of how requests have been served so far.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Close stops background refills. Leases still in the cache are abandoned.
+func (c *Cache) Close() {
+	close(c.stop)
+	<-c.done
+}
+
+func (c *Cache) context(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", c.apikey)
+}
+
+// pool returns the pool for sel, creating it if needed. c.mu must be held.
+func (c *Cache) pool(sel Selector) *pool {
+	key := sel.Key()
+	p, ok := c.pools[key]
+	if !ok {
+		p = &pool{sel: sel}
+		c.pools[key] = p
+	}
+	return p
+}
+
+// expire drops leases which have expired. c.mu must be held.
+func (c *Cache) expire(p *pool, now time.Time) {
+	n := 0
+	for n < len(p.leases) && !p.leases[n].expires.After(now) {
+		n++
+	}
+	c.stats.Expired += n
+	p.leases = p.leases[n:]
+}
+
+// take removes and returns the soonest expiring lease which can serve the request, or nil.
+func (p *pool) take(sel Selector, weight float32) *held {
+	for i, h := range p.leases {
+		l := h.lease
+		if l.GetFeature() != "" && l.GetFeature() != sel.Feature {
+			continue
+		}
+		if l.GetPriorityBoost() != sel.PriorityBoost || l.GetWeight() < weight {
+			continue
+		}
+		p.leases = append(p.leases[:i], p.leases[i+1:]...)
+		return h
+	}
+	return nil
+}
+
+// maybeRefill starts a background refill if p is running low or about to expire. c.mu must be held.
+func (c *Cache) maybeRefill(p *pool, now time.Time) {
+	if p.refilling || now.Before(p.retryAt) {
+		return
+	}
+	low := len(p.leases) <= c.lowWater
+	expiring := len(p.leases) > 0 && p.leases[0].expires.Before(now.Add(c.refillAhead))
+	if !low && !expiring {
+		return
+	}
+	p.refilling = true
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		c.refill(ctx, p)
+	}()
+}
+
+// refill asks the hub for more leases for p. The caller must have set p.refilling, so that only one refill
+// runs at a time and quota isn't leased twice.
+func (c *Cache) refill(ctx context.Context, p *pool) error {
+	c.mu.Lock()
+	req := &pb.GetTokenLeaseRequest{
+		Selector:      p.sel.featureSelector(),
+		PriorityBoost: proto.Int32(p.sel.PriorityBoost),
+	}
+	if p.weight > 0 {
+		req.DefaultWeight = proto.Float32(p.weight)
+	}
+	if c.clientID != "" {
+		req.ClientId = proto.String(c.clientID)
+	}
+	c.stats.Refills++
+	c.mu.Unlock()
+
+	received := time.Now()
+	res, err := c.client.GetTokenLease(c.context(ctx), req)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p.refilling = false
+	if err != nil || !res.GetGranted() {
+		c.stats.RefillErrs++
+		p.retryAt = time.Now().Add(c.backoff)
+		return err
+	}
+	for _, l := range res.GetLeases() {
+		expires := received.Add(time.Duration(l.GetDurationMsec()) * time.Millisecond)
+		if l.ExpiresAt != nil {
+			expires = l.GetExpiresAt().AsTime()
+		}
+		p.leases = append(p.leases, &held{lease: l, expires: expires})
+	}
+	sort.Slice(p.leases, func(i, j int) bool { return p.leases[i].expires.Before(p.leases[j].expires) })
+	return nil
+}
+
+// loop refills pools which are in use ahead of expiry, and drops expired leases, until Close is called.
+func (c *Cache) loop() {
+	defer close(c.done)
+	interval := c.refillAhead / 2
+	if interval <= 0 {
+		interval = DefaultRefillAhead / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for key, p := range c.pools {
+				c.expire(p, now)
+				if now.Sub(p.lastUsed) > c.idleTimeout {
+					if len(p.leases) == 0 && !p.refilling {
+						delete(c.pools, key)
+					}
+					continue
+				}
+				c.maybeRefill(p, now)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
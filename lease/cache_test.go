@@ -0,0 +1,173 @@
+package lease
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTake(t *testing.T) {
+	now := time.Now()
+	lease := func(token, feature string, boost int32, weight float32) *pb.TokenLease {
+		return &pb.TokenLease{Token: token, Feature: feature, PriorityBoost: boost, Weight: weight}
+	}
+	// Sorted by expiry, as pools are.
+	leases := []*pb.TokenLease{
+		lease("search-light", "search", 0, 1),
+		lease("any-light", "", 0, 1),
+		lease("search-heavy", "search", 0, 5),
+		lease("search-boosted", "search", 2, 1),
+	}
+	tests := []struct {
+		name    string
+		feature string
+		boost   int32
+		weight  float32
+		expect  string // token taken, or "" for none
+	}{
+		{"soonest expiring match", "search", 0, 1, "search-light"},
+		{"lease for every feature", "browse", 0, 1, "any-light"},
+		{"weight too large for light leases", "search", 0, 3, "search-heavy"},
+		{"weight too large for any lease", "search", 0, 10, ""},
+		{"priority boost must match", "search", 2, 1, "search-boosted"},
+		{"no lease with the priority boost", "browse", 2, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pool{}
+			for i, l := range leases {
+				p.leases = append(p.leases, &held{lease: l, expires: now.Add(time.Duration(i+1) * time.Second)})
+			}
+			h := p.take(Selector{Guard: "g", Feature: tt.feature, PriorityBoost: tt.boost}, tt.weight)
+			got := ""
+			if h != nil {
+				got = h.lease.GetToken()
+			}
+			if got != tt.expect {
+				t.Fatalf("got %q, want %q", got, tt.expect)
+			}
+			want := len(leases)
+			if got != "" {
+				want--
+			}
+			if len(p.leases) != want {
+				t.Errorf("%d leases left, want %d", len(p.leases), want)
+			}
+			for _, h := range p.leases {
+				if h.lease.GetToken() == got {
+					t.Errorf("lease %q was left in the pool", got)
+				}
+			}
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		expires []time.Duration // of each lease, from now
+		left    int
+	}{
+		{"none expired", []time.Duration{time.Second, 2 * time.Second}, 2},
+		{"some expired", []time.Duration{-time.Second, 0, time.Second}, 1},
+		{"all expired", []time.Duration{-2 * time.Second, -time.Second}, 0},
+		{"empty", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cache{}
+			p := &pool{}
+			for _, d := range tt.expires {
+				p.leases = append(p.leases, &held{lease: &pb.TokenLease{}, expires: now.Add(d)})
+			}
+			c.expire(p, now)
+			if len(p.leases) != tt.left {
+				t.Errorf("%d leases left, want %d", len(p.leases), tt.left)
+			}
+			if got, want := c.Stats().Expired, len(tt.expires)-tt.left; got != want {
+				t.Errorf("counted %d expired, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSelectorKey(t *testing.T) {
+	tag := func(k, v string) *pb.Tag { return &pb.Tag{Key: k, Value: v} }
+	base := Selector{Environment: "prod", Guard: "g", Tags: []*pb.Tag{tag("a", "1"), tag("b", "2")}}
+	tests := []struct {
+		name  string
+		other Selector
+		same  bool
+	}{
+		{"tags in another order", Selector{Environment: "prod", Guard: "g", Tags: []*pb.Tag{tag("b", "2"), tag("a", "1")}}, true},
+		{"separators in a tag value", Selector{Environment: "prod", Guard: "g", Tags: []*pb.Tag{tag("a", `1","b"="2`)}}, false},
+		{"separators in a tag key", Selector{Environment: "prod", Guard: "g", Tags: []*pb.Tag{tag(`a=1,b`, "2")}}, false},
+		{"separators in a name", Selector{Environment: `prod","g`, Tags: base.Tags}, false},
+		{"different priority boost", Selector{Environment: "prod", Guard: "g", PriorityBoost: 1, Tags: base.Tags}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := base.Key() == tt.other.Key(); same != tt.same {
+				t.Errorf("keys %q and %q: same is %v, want %v", base.Key(), tt.other.Key(), same, tt.same)
+			}
+		})
+	}
+}
+
+// leaseHub answers GetTokenLease calls with a lease once release is closed.
+type leaseHub struct {
+	called  chan struct{}
+	release chan struct{}
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (h *leaseHub) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	h.mu.Lock()
+	h.calls++
+	h.mu.Unlock()
+	h.called <- struct{}{}
+	<-h.release
+	proto.Merge(reply.(proto.Message), &pb.GetTokenLeaseResponse{
+		Granted: true,
+		Leases:  []*pb.TokenLease{{Token: "a", Weight: 1, DurationMsec: 60000}, {Token: "b", Weight: 1, DurationMsec: 60000}},
+	})
+	return nil
+}
+
+func (h *leaseHub) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	panic("not implemented")
+}
+
+func TestPrefetchWhileRefilling(t *testing.T) {
+	hub := &leaseHub{called: make(chan struct{}, 2), release: make(chan struct{})}
+	c := NewCache(hub, "key", WithRefillAhead(time.Hour))
+	defer c.Close()
+	sel := Selector{Environment: "prod", Guard: "g"}
+
+	first := make(chan error)
+	go func() { first <- c.Prefetch(context.Background(), sel, 1) }()
+	<-hub.called
+	// The first refill is still waiting for the hub, so this one must not ask for more leases.
+	if err := c.Prefetch(context.Background(), sel, 1); err != nil {
+		t.Fatal(err)
+	}
+	close(hub.release)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	if hub.calls != 1 {
+		t.Errorf("got %d GetTokenLease calls, want 1", hub.calls)
+	}
+	if got := c.Stats().Refills; got != 1 {
+		t.Errorf("got %d refills, want 1", got)
+	}
+}
@@ -0,0 +1,110 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Tokens issues quota tokens. It is satisfied by *Cache and *Direct.
+type Tokens interface {
+	Get(ctx context.Context, sel Selector, weight float32) (*Grant, error)
+}
+
+// Fields are the values extracted from a request to find its Selector and weight, such as by the httpquota
+// and grpcquota middleware. Only Guard is required. PriorityBoost must be an integer and Weight a number,
+// if they are set; tags with no value are left out.
+type Fields struct {
+	Environment   string
+	Guard         string
+	Feature       string
+	Tags          map[string]string
+	PriorityBoost string
+	Weight        string
+}
+
+// Selector parses f into a Selector and the request's weight, which is zero if f has none.
+func (f Fields) Selector() (Selector, float32, error) {
+	sel := Selector{Environment: f.Environment, Guard: f.Guard, Feature: f.Feature}
+	if sel.Guard == "" {
+		return sel, 0, errors.New("no Guard")
+	}
+	for key, v := range f.Tags {
+		if v != "" {
+			sel.Tags = append(sel.Tags, &pb.Tag{Key: key, Value: v})
+		}
+	}
+	if f.PriorityBoost != "" {
+		boost, err := strconv.ParseInt(f.PriorityBoost, 10, 32)
+		if err != nil {
+			return sel, 0, fmt.Errorf("priority boost: %w", err)
+		}
+		sel.PriorityBoost = int32(boost)
+	}
+	var weight float32
+	if f.Weight != "" {
+		w, err := strconv.ParseFloat(f.Weight, 32)
+		if err != nil {
+			return sel, 0, fmt.Errorf("weight: %w", err)
+		}
+		weight = float32(w)
+	}
+	return sel, weight, nil
+}
+
+// Decision is the outcome of checking a request's quota.
+type Decision struct {
+	Selector Selector
+	Weight   float32
+	Quota    pb.Quota
+	Grant    *Grant // nil if quota could not be checked
+	Err      error
+	Allowed  bool
+}
+
+// Decider checks the quota of requests for middleware which admits them.
+type Decider struct {
+	Tokens  Tokens
+	Timeout time.Duration // how long a request waits for quota
+	// FailClosed refuses requests when quota could not be checked. By default they are let through.
+	FailClosed bool
+}
+
+// Decide checks the quota of a request for sel and weight. err is the error from finding the selector,
+// if there was one, which makes the decision QUOTA_LOCAL_ERROR without asking for a token.
+func (dc Decider) Decide(ctx context.Context, sel Selector, weight float32, err error) *Decision {
+	d := &Decision{Selector: sel, Weight: weight}
+	if err != nil {
+		d.Quota, d.Err, d.Allowed = pb.Quota_QUOTA_LOCAL_ERROR, err, !dc.FailClosed
+		return d
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dc.Timeout)
+	defer cancel()
+	d.Grant, d.Err = dc.Tokens.Get(ctx, sel, weight)
+	d.Quota = Status(d.Grant, d.Err)
+	if d.Err != nil {
+		d.Grant = nil
+		d.Allowed = !dc.FailClosed
+	} else {
+		d.Allowed = d.Grant.Allowed()
+	}
+	return d
+}
+
+// Report reports d's token as consumed with r, if r is not nil, once the request has completed. It is reported
+// at the weight the request was checked with, or 1 if it had none, since a lease may have been granted for more.
+func (d *Decision) Report(r *Reporter) {
+	if r == nil || d.Grant == nil {
+		return
+	}
+	weight := d.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	r.Report(d.Grant, weight)
+}
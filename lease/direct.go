@@ -0,0 +1,53 @@
+package lease
+
+import (
+	"context"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Direct requests a token with GetToken for every request. It has the same Get method as Cache,
+// for services which would rather not hold leases.
+type Direct struct {
+	client   pb.QuotaServiceClient
+	apikey   string
+	clientID string
+}
+
+// NewDirect returns a Direct which authenticates to the hub on conn with apikey.
+// clientID is optional; see WithClientID.
+func NewDirect(conn grpc.ClientConnInterface, apikey, clientID string) *Direct {
+	return &Direct{client: pb.NewQuotaServiceClient(conn), apikey: apikey, clientID: clientID}
+}
+
+// Get requests a token for a request of the given weight. A weight of zero is treated as 1.
+func (d *Direct) Get(ctx context.Context, sel Selector, weight float32) (*Grant, error) {
+	if weight <= 0 {
+		weight = 1
+	}
+	req := &pb.GetTokenRequest{
+		Selector:      sel.featureSelector(),
+		PriorityBoost: proto.Int32(sel.PriorityBoost),
+		Weight:        proto.Float32(weight),
+	}
+	if d.clientID != "" {
+		req.ClientId = proto.String(d.clientID)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", d.apikey)
+	res, err := d.client.GetToken(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &Grant{
+		Granted:     res.GetGranted(),
+		Token:       res.GetToken(),
+		Reason:      res.GetReason(),
+		Mode:        res.GetMode(),
+		Weight:      weight,
+		Environment: sel.Environment,
+	}, nil
+}
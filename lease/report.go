@@ -0,0 +1,240 @@
+package lease
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Defaults for the Reporter options.
+const (
+	DefaultBatchSize     = 100
+	DefaultFlushInterval = time.Second
+	DefaultMaxRetries    = 5
+	DefaultRetryBackoff  = 100 * time.Millisecond
+	DefaultMaxBackoff    = 5 * time.Second
+)
+
+// ReporterStats counts what a Reporter has sent.
+type ReporterStats struct {
+	Reported int // tokens reported successfully
+	Dropped  int // tokens given up on after running out of retries
+	Calls    int // SetTokenLeaseConsumed calls, including retries
+	Retries  int
+}
+
+// Reporter reports consumed leases to the hub with SetTokenLeaseConsumed in the background.
+// Tokens are batched per environment and weight correction, and a batch is sent when it is full or
+// when the flush interval passes. It is safe for concurrent use.
+type Reporter struct {
+	client     pb.QuotaServiceClient
+	apikey     string
+	batchSize  int
+	interval   time.Duration
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	timeout    time.Duration
+
+	mu      sync.Mutex
+	pending map[batchKey][]string
+	stats   ReporterStats
+	full    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// batchKey groups tokens which can be reported in one call, as the weight correction applies to every token in it.
+type batchKey struct {
+	environment string
+	corrected   bool
+	weight      float32
+}
+
+// ReporterOption configures a Reporter.
+type ReporterOption func(*Reporter)
+
+// WithBatchSize sends a batch as soon as it holds n tokens.
+func WithBatchSize(n int) ReporterOption {
+	return func(r *Reporter) {
+		r.batchSize = n
+	}
+}
+
+// WithFlushInterval sends every pending batch at least this often.
+func WithFlushInterval(d time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.interval = d
+	}
+}
+
+// WithRetries retries a failed call up to n times, starting with a wait of backoff which doubles
+// after every attempt up to maxBackoff.
+func WithRetries(n int, backoff, maxBackoff time.Duration) ReporterOption {
+	return func(r *Reporter) {
+		r.maxRetries, r.backoff, r.maxBackoff = n, backoff, maxBackoff
+	}
+}
+
+// NewReporter returns a Reporter which authenticates to the hub on conn with apikey.
+// Close must be called to send the last batches.
+func NewReporter(conn grpc.ClientConnInterface, apikey string, opts ...ReporterOption) *Reporter {
+	r := &Reporter{
+		client:     pb.NewQuotaServiceClient(conn),
+		apikey:     apikey,
+		batchSize:  DefaultBatchSize,
+		interval:   DefaultFlushInterval,
+		maxRetries: DefaultMaxRetries,
+		backoff:    DefaultRetryBackoff,
+		maxBackoff: DefaultMaxBackoff,
+		timeout:    5 * time.Second,
+		pending:    make(map[batchKey][]string),
+		full:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	go r.loop()
+	return r
+}
+
+// Report records that the request g was granted for has completed, with the given actual weight.
+// If the weight differs from the one the lease was granted for, it is sent as a weight correction;
+// a weight of zero means the estimate was right. Grants which did not come from a lease are ignored.
+func (r *Reporter) Report(g *Grant, weight float32) {
+	if !g.Leased {
+		return
+	}
+	if weight <= 0 || weight == g.Weight {
+		r.Consumed(g.Environment, g.Token)
+		return
+	}
+	r.ConsumedWeight(g.Environment, g.Token, weight)
+}
+
+// Consumed queues a leased token to be reported as consumed at its leased weight.
+func (r *Reporter) Consumed(environment, token string) {
+	r.add(batchKey{environment: environment}, token)
+}
+
+// ConsumedWeight queues a leased token to be reported as consumed by a request of the given actual weight.
+func (r *Reporter) ConsumedWeight(environment, token string, weight float32) {
+	r.add(batchKey{environment: environment, corrected: true, weight: weight}, token)
+}
+
+func (r *Reporter) add(key batchKey, token string) {
+	r.mu.Lock()
+	r.pending[key] = append(r.pending[key], token)
+	full := len(r.pending[key]) >= r.batchSize
+	r.mu.Unlock()
+	if full {
+		select {
+		case r.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Stats returns counts of what has been reported so far.
+func (r *Reporter) Stats() ReporterStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Close sends every pending batch and stops the Reporter. Batches still failing when ctx
+// is done are dropped.
+func (r *Reporter) Close(ctx context.Context) {
+	close(r.stop)
+	<-r.done
+	r.flush(ctx)
+}
+
+func (r *Reporter) loop() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		case <-r.full:
+		}
+		r.flush(context.Background())
+	}
+}
+
+// flush sends every pending batch, in calls of at most batchSize tokens.
+func (r *Reporter) flush(ctx context.Context) {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[batchKey][]string)
+	r.mu.Unlock()
+
+	for key, tokens := range pending {
+		for len(tokens) > 0 {
+			n := min(len(tokens), r.batchSize)
+			r.send(ctx, key, tokens[:n])
+			tokens = tokens[n:]
+		}
+	}
+}
+
+// send reports one batch, retrying with backoff.
+func (r *Reporter) send(ctx context.Context, key batchKey, tokens []string) {
+	req := &pb.SetTokenLeaseConsumedRequest{Tokens: tokens, Environment: key.environment}
+	if key.corrected {
+		req.WeightCorrection = proto.Float32(key.weight)
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", r.apikey)
+
+	backoff := r.backoff
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, r.timeout)
+		_, err := r.client.SetTokenLeaseConsumed(callCtx, req)
+		cancel()
+
+		r.mu.Lock()
+		r.stats.Calls++
+		done := true
+		switch {
+		case err == nil:
+			r.stats.Reported += len(tokens)
+		case attempt < r.maxRetries && retryable(err) && ctx.Err() == nil:
+			r.stats.Retries++
+			done = false
+		default:
+			r.stats.Dropped += len(tokens)
+		}
+		r.mu.Unlock()
+		if done {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, r.maxBackoff)
+	}
+}
+
+// retryable reports whether a failed call might succeed if it is retried.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package lease
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeHub records SetTokenLeaseConsumed calls, failing them with errs in turn until they run out.
+type fakeHub struct {
+	mu    sync.Mutex
+	errs  []error
+	calls []*pb.SetTokenLeaseConsumedRequest
+}
+
+func (h *fakeHub) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, proto.Clone(args.(proto.Message)).(*pb.SetTokenLeaseConsumedRequest))
+	if len(h.errs) > 0 {
+		err := h.errs[0]
+		h.errs = h.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (h *fakeHub) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	panic("not implemented")
+}
+
+// batches describes each call as "environment[/weight]: tokens", sorted.
+func (h *fakeHub) batches() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var batches []string
+	for _, req := range h.calls {
+		env := req.GetEnvironment()
+		if req.WeightCorrection != nil {
+			env = fmt.Sprintf("%s/%v", env, req.GetWeightCorrection())
+		}
+		batches = append(batches, env+": "+strings.Join(req.GetTokens(), ","))
+	}
+	sort.Strings(batches)
+	return batches
+}
+
+func TestReporterBatching(t *testing.T) {
+	hub := &fakeHub{}
+	r := NewReporter(hub, "key", WithBatchSize(2), WithFlushInterval(time.Hour))
+	leased := func(env, token string, weight float32) *Grant {
+		return &Grant{Granted: true, Token: token, Weight: weight, Leased: true, Environment: env}
+	}
+	r.Report(leased("prod", "a", 1), 1)
+	r.Report(leased("prod", "b", 2), 0) // the estimate was right
+	r.Report(leased("prod", "c", 5), 3)
+	r.Report(leased("prod", "d", 5), 3)
+	r.Report(leased("prod", "e", 1), 1)
+	r.Report(leased("dev", "f", 1), 1)
+	r.Report(&Grant{Granted: true, Token: "g", Weight: 1, Environment: "prod"}, 1) // not leased
+	r.Close(context.Background())
+
+	expect := []string{"dev: f", "prod/3: c,d", "prod: a,b", "prod: e"}
+	if got := hub.batches(); strings.Join(got, "; ") != strings.Join(expect, "; ") {
+		t.Errorf("got calls %q, want %q", got, expect)
+	}
+	if got := r.Stats(); got != (ReporterStats{Reported: 6, Calls: 4}) {
+		t.Errorf("got stats %+v", got)
+	}
+}
+
+func TestReporterRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "down")
+	tests := []struct {
+		name   string
+		errs   []error
+		expect ReporterStats
+	}{
+		{"success", nil, ReporterStats{Reported: 1, Calls: 1}},
+		{"succeeds on retry", []error{unavailable, unavailable}, ReporterStats{Reported: 1, Calls: 3, Retries: 2}},
+		{"runs out of retries", []error{unavailable, unavailable, unavailable, unavailable}, ReporterStats{Dropped: 1, Calls: 3, Retries: 2}},
+		{"not retryable", []error{status.Error(codes.InvalidArgument, "bad token")}, ReporterStats{Dropped: 1, Calls: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &fakeHub{errs: tt.errs}
+			r := NewReporter(hub, "key", WithFlushInterval(time.Hour), WithRetries(2, time.Millisecond, 2*time.Millisecond))
+			r.Consumed("prod", "a")
+			r.Close(context.Background())
+			if got := r.Stats(); got != tt.expect {
+				t.Errorf("got %+v, want %+v", got, tt.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package lease
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Status classifies the result of a Get as the Quota status reported by Stanza SDKs.
+func Status(g *Grant, err error) pb.Quota {
+	switch {
+	case err == nil && g.Granted:
+		return pb.Quota_QUOTA_GRANTED
+	case err == nil:
+		return pb.Quota_QUOTA_BLOCKED
+	case errors.Is(err, context.DeadlineExceeded) || status.Code(err) == codes.DeadlineExceeded:
+		return pb.Quota_QUOTA_TIMEOUT
+	}
+	return pb.Quota_QUOTA_ERROR
+}
+
+// Allowed reports whether a request may go ahead: it was granted, or its Guard is in report-only mode.
+func (g *Grant) Allowed() bool {
+	return g.Granted || g.Mode == pb.Mode_MODE_REPORT_ONLY
+}
@@ -0,0 +1,194 @@
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Arrival describes when new streams are opened.
+type Arrival interface {
+	// Next returns the time until the next arrival and how many streams arrive together.
+	Next(r *rand.Rand) (time.Duration, int)
+}
+
+// NewArrival returns the named arrival process with a mean rate of rate streams per second.
+// Supported processes are "poisson", "uniform" and "bursty". Bursty arrivals open burst
+// streams at once, at Poisson distributed intervals which preserve the mean rate.
+func NewArrival(name string, rate float64, burst int) (Arrival, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("arrival rate must be positive, got %g", rate)
+	}
+	switch name {
+	case "poisson":
+		return poisson{rate: rate, size: 1}, nil
+	case "uniform":
+		return uniform{gap: time.Duration(float64(time.Second) / rate)}, nil
+	case "bursty":
+		if burst < 1 {
+			return nil, fmt.Errorf("burst size must be at least 1, got %d", burst)
+		}
+		return poisson{rate: rate / float64(burst), size: burst}, nil
+	default:
+		return nil, fmt.Errorf("unknown arrival process %q, must be one of poisson, uniform, bursty", name)
+	}
+}
+
+type poisson struct {
+	rate float64
+	size int
+}
+
+func (p poisson) Next(r *rand.Rand) (time.Duration, int) {
+	return time.Duration(r.ExpFloat64() / p.rate * float64(time.Second)), p.size
+}
+
+type uniform struct {
+	gap time.Duration
+}
+
+func (u uniform) Next(*rand.Rand) (time.Duration, int) {
+	return u.gap, 1
+}
+
+// Distribution draws stream durations.
+type Distribution func(r *rand.Rand) time.Duration
+
+// NewDistribution returns the named duration distribution with the given mean.
+// Supported distributions are "fixed", "exponential" and "uniform" (between half and one and a half times the mean).
+func NewDistribution(name string, mean time.Duration) (Distribution, error) {
+	if mean <= 0 {
+		return nil, fmt.Errorf("mean duration must be positive, got %v", mean)
+	}
+	switch name {
+	case "fixed":
+		return func(*rand.Rand) time.Duration { return mean }, nil
+	case "exponential":
+		return func(r *rand.Rand) time.Duration { return time.Duration(r.ExpFloat64() * float64(mean)) }, nil
+	case "uniform":
+		return func(r *rand.Rand) time.Duration { return time.Duration((0.5 + r.Float64()) * float64(mean)) }, nil
+	default:
+		return nil, fmt.Errorf("unknown duration distribution %q, must be one of fixed, exponential, uniform", name)
+	}
+}
+
+type choice[T any] struct {
+	value  T
+	weight float64
+}
+
+// mix is a weighted random choice between values.
+type mix[T any] struct {
+	choices []choice[T]
+	total   float64
+}
+
+func (m *mix[T]) add(value T, weight float64) {
+	m.choices = append(m.choices, choice[T]{value: value, weight: weight})
+	m.total += weight
+}
+
+// pick returns a value chosen in proportion to the weights, or the zero value if the mix is empty.
+func (m *mix[T]) pick(r *rand.Rand) T {
+	if len(m.choices) == 0 {
+		var zero T
+		return zero
+	}
+	n := r.Float64() * m.total
+	for _, c := range m.choices {
+		if n < c.weight {
+			return c.value
+		}
+		n -= c.weight
+	}
+	return m.choices[len(m.choices)-1].value
+}
+
+// PriorityMix chooses the PriorityBoost of each new stream.
+type PriorityMix struct {
+	mix[int32]
+}
+
+// ParsePriorityMix parses a comma separated list of boost:weight pairs, such as "0:8,5:2".
+// An empty string always chooses a boost of zero.
+func ParsePriorityMix(s string) (*PriorityMix, error) {
+	m := &PriorityMix{}
+	if s == "" {
+		m.add(0, 1)
+		return m, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		b, w, err := splitWeight(part)
+		if err != nil {
+			return nil, err
+		}
+		boost, err := strconv.ParseInt(b, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("priority %q: %w", part, err)
+		}
+		m.add(int32(boost), w)
+	}
+	return m, nil
+}
+
+// Pick returns a priority boost.
+func (m *PriorityMix) Pick(r *rand.Rand) int32 {
+	return m.pick(r)
+}
+
+// TagMix chooses the tags of each new stream, picking one value for every tag key.
+type TagMix struct {
+	keys  []string
+	mixes map[string]*mix[string]
+}
+
+// ParseTagMix parses a comma separated list of key=value:weight entries, such as
+// "tier=free:3,tier=paid:1,region=us:1". An empty string adds no tags.
+func ParseTagMix(s string) (*TagMix, error) {
+	m := &TagMix{mixes: make(map[string]*mix[string])}
+	if s == "" {
+		return m, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		kv, w, err := splitWeight(part)
+		if err != nil {
+			return nil, err
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("tag %q: expected key=value:weight", part)
+		}
+		if _, ok := m.mixes[k]; !ok {
+			m.keys = append(m.keys, k)
+			m.mixes[k] = &mix[string]{}
+		}
+		m.mixes[k].add(v, w)
+	}
+	return m, nil
+}
+
+// Pick returns one tag for every key in the mix.
+func (m *TagMix) Pick(r *rand.Rand) []*pb.Tag {
+	tags := make([]*pb.Tag, 0, len(m.keys))
+	for _, k := range m.keys {
+		tags = append(tags, &pb.Tag{Key: k, Value: m.mixes[k].pick(r)})
+	}
+	return tags
+}
+
+// splitWeight splits "value:weight", defaulting the weight to 1.
+func splitWeight(s string) (string, float64, error) {
+	v, w, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return v, 1, nil
+	}
+	weight, err := strconv.ParseFloat(w, 64)
+	if err != nil || weight < 0 {
+		return "", 0, fmt.Errorf("%q: weight must be a non-negative number", s)
+	}
+	return v, weight, nil
+}
@@ -0,0 +1,181 @@
+// Package loadgen drives synthetic stream traffic against a Stream Balancer Guard
+// and reports throughput, latency, denials, utilization and fairness between customers.
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Updater issues UpdateStreams calls. It is satisfied by *streams.Client.
+type Updater interface {
+	Update(ctx context.Context, reqs []*pb.StreamRequest, ended []string) (*pb.UpdateStreamsResponse, error)
+}
+
+// Config describes the simulated traffic.
+type Config struct {
+	Customers      int           // number of distinct customer_id tag values
+	Duration       time.Duration // how long to generate traffic for
+	Tick           time.Duration // arrivals and departures within a tick are sent in one UpdateStreams call
+	Arrival        Arrival       // required
+	StreamDuration Distribution  // required
+	MinWeight      float32
+	MaxWeight      float32      // must be positive and at least MinWeight
+	Priorities     *PriorityMix // no boost if nil
+	Tags           *TagMix      // tags added to every stream as well as customer_id; none if nil
+	Limit          float32      // the Guard's overall limit, used to report utilization if positive
+	Seed           int64
+}
+
+type activeStream struct {
+	customer  int
+	endAt     time.Time
+	allocated float32
+}
+
+// Run generates traffic until cfg.Duration has passed or ctx is cancelled, then ends
+// every stream it opened. The returned report covers the whole run.
+func Run(ctx context.Context, client Updater, cfg Config) (*Report, error) {
+	if cfg.Customers < 1 {
+		return nil, fmt.Errorf("need at least one customer, got %d", cfg.Customers)
+	}
+	if cfg.Tick <= 0 {
+		return nil, fmt.Errorf("tick must be positive, got %s", cfg.Tick)
+	}
+	if cfg.Duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive, got %s", cfg.Duration)
+	}
+	if cfg.Arrival == nil {
+		return nil, fmt.Errorf("no arrival process")
+	}
+	if cfg.StreamDuration == nil {
+		return nil, fmt.Errorf("no stream duration distribution")
+	}
+	if cfg.MinWeight < 0 || cfg.MaxWeight <= 0 || cfg.MaxWeight < cfg.MinWeight {
+		return nil, fmt.Errorf("weights must be 0 <= min <= max and max > 0, got min %g and max %g", cfg.MinWeight, cfg.MaxWeight)
+	}
+	if cfg.Limit < 0 {
+		return nil, fmt.Errorf("limit must not be negative, got %g", cfg.Limit)
+	}
+	if cfg.Priorities == nil {
+		cfg.Priorities = &PriorityMix{}
+	}
+	if cfg.Tags == nil {
+		cfg.Tags = &TagMix{}
+	}
+
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	start := time.Now()
+	report := newReport(cfg)
+	active := make(map[string]*activeStream)
+	var pendingEnd []string // denied or failed streams, ended so that the hub does not hold on to them
+	seq := 0
+
+	gap, count := cfg.Arrival.Next(rng)
+	nextArrival := start.Add(gap)
+
+	ticker := time.NewTicker(cfg.Tick)
+	defer ticker.Stop()
+
+loop:
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			break loop
+		case now = <-ticker.C:
+		}
+		if now.Sub(start) >= cfg.Duration {
+			break
+		}
+
+		ended := pendingEnd
+		pendingEnd = nil
+		for id, s := range active {
+			if !now.Before(s.endAt) {
+				ended = append(ended, id)
+				delete(active, id)
+			}
+		}
+
+		var reqs []*pb.StreamRequest
+		opened := make(map[string]*activeStream)
+		for !nextArrival.After(now) {
+			for i := 0; i < count; i++ {
+				seq++
+				customer := rng.Intn(cfg.Customers)
+				req := &pb.StreamRequest{
+					StreamId:  fmt.Sprintf("loadgen-%d-%d", start.Unix(), seq),
+					MinWeight: cfg.MinWeight,
+					MaxWeight: cfg.MaxWeight,
+					Tags:      append([]*pb.Tag{{Key: "customer_id", Value: customerName(customer)}}, cfg.Tags.Pick(rng)...),
+				}
+				if boost := cfg.Priorities.Pick(rng); boost != 0 {
+					req.PriorityBoost = &boost
+				}
+				reqs = append(reqs, req)
+				opened[req.StreamId] = &activeStream{customer: customer, endAt: now.Add(cfg.StreamDuration(rng))}
+				report.customers[customer].Requested++
+			}
+			gap, count = cfg.Arrival.Next(rng)
+			nextArrival = nextArrival.Add(gap)
+		}
+
+		if len(reqs) > 0 || len(ended) > 0 {
+			callStart := time.Now()
+			res, err := client.Update(ctx, reqs, ended)
+			report.latencies = append(report.latencies, time.Since(callStart))
+			report.Calls++
+			if err != nil {
+				report.Errors++
+				for id, s := range opened {
+					pendingEnd = append(pendingEnd, id)
+					report.customers[s.customer].Errors++
+				}
+			} else {
+				for _, r := range res.GetResults() {
+					if s, ok := active[r.GetStreamId()]; ok {
+						s.allocated = r.GetAllocatedWeight()
+					}
+					if s, ok := opened[r.GetStreamId()]; ok {
+						s.allocated = r.GetAllocatedWeight()
+					}
+				}
+				for id, s := range opened {
+					if s.allocated > 0 {
+						active[id] = s
+						report.customers[s.customer].Granted++
+					} else {
+						pendingEnd = append(pendingEnd, id)
+						report.customers[s.customer].Denied++
+					}
+				}
+			}
+		}
+		report.sample(active)
+	}
+
+	report.Elapsed = time.Since(start)
+
+	// Always clean up, even if ctx was cancelled, so that quota does not leak away.
+	ended := pendingEnd
+	for id := range active {
+		ended = append(ended, id)
+	}
+	if len(ended) > 0 {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := client.Update(cleanupCtx, nil, ended); err != nil {
+			return report, fmt.Errorf("ending %d streams: %w", len(ended), err)
+		}
+	}
+	return report, nil
+}
+
+func customerName(i int) string {
+	return fmt.Sprintf("customer%d", i+1)
+}
@@ -0,0 +1,84 @@
+package loadgen
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// grantAll allocates every stream its MaxWeight, and remembers which streams are still open.
+type grantAll struct {
+	mu   sync.Mutex
+	open map[string]bool
+}
+
+func (g *grantAll) Update(ctx context.Context, reqs []*pb.StreamRequest, ended []string) (*pb.UpdateStreamsResponse, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	res := &pb.UpdateStreamsResponse{}
+	for _, id := range ended {
+		delete(g.open, id)
+	}
+	for _, req := range reqs {
+		g.open[req.GetStreamId()] = true
+		res.Results = append(res.Results, &pb.StreamResult{StreamId: req.GetStreamId(), AllocatedWeight: req.GetMaxWeight()})
+	}
+	return res, nil
+}
+
+func TestRun(t *testing.T) {
+	fixed := func(*rand.Rand) time.Duration { return 5 * time.Millisecond }
+	valid := Config{
+		Customers:      2,
+		Duration:       30 * time.Millisecond,
+		Tick:           time.Millisecond,
+		Arrival:        uniform{gap: time.Millisecond},
+		StreamDuration: fixed,
+		MaxWeight:      1,
+	}
+	with := func(f func(*Config)) Config {
+		cfg := valid
+		f(&cfg)
+		return cfg
+	}
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"no priorities or tags", valid, true},
+		{"empty mixes", with(func(c *Config) { c.Priorities, c.Tags = &PriorityMix{}, &TagMix{} }), true},
+		{"zero config", Config{}, false},
+		{"no customers", with(func(c *Config) { c.Customers = 0 }), false},
+		{"no tick", with(func(c *Config) { c.Tick = 0 }), false},
+		{"no duration", with(func(c *Config) { c.Duration = 0 }), false},
+		{"no arrival process", with(func(c *Config) { c.Arrival = nil }), false},
+		{"no stream durations", with(func(c *Config) { c.StreamDuration = nil }), false},
+		{"no max weight", with(func(c *Config) { c.MaxWeight = 0 }), false},
+		{"min weight over max", with(func(c *Config) { c.MinWeight = 2 }), false},
+		{"negative min weight", with(func(c *Config) { c.MinWeight = -1 }), false},
+		{"negative limit", with(func(c *Config) { c.Limit = -1 }), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &grantAll{open: make(map[string]bool)}
+			report, err := Run(context.Background(), hub, tt.cfg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok %v", err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			if report.Calls == 0 {
+				t.Errorf("made no UpdateStreams calls")
+			}
+			if len(hub.open) > 0 {
+				t.Errorf("%d streams left open", len(hub.open))
+			}
+		})
+	}
+}
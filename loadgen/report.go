@@ -0,0 +1,166 @@
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// CustomerStats summarises the streams opened for one customer.
+type CustomerStats struct {
+	Name      string
+	Requested int
+	Granted   int
+	Denied    int
+	Errors    int     // streams whose UpdateStreams call failed
+	weightSum float64 // allocated weight summed over all samples
+}
+
+// Report summarises a load generation run.
+type Report struct {
+	Elapsed   time.Duration
+	Calls     int
+	Errors    int
+	Limit     float32
+	latencies []time.Duration
+	customers []*CustomerStats
+	samples   int
+	utilSum   float64
+	utilMax   float64
+	jainSum   float64 // instantaneous Jain's index summed over samples with demand
+	jainN     int
+}
+
+func newReport(cfg Config) *Report {
+	r := &Report{Limit: cfg.Limit}
+	for i := 0; i < cfg.Customers; i++ {
+		r.customers = append(r.customers, &CustomerStats{Name: customerName(i)})
+	}
+	return r
+}
+
+// sample records the current allocation of every active stream.
+func (r *Report) sample(active map[string]*activeStream) {
+	perCustomer := make([]float64, len(r.customers))
+	var total float64
+	for _, s := range active {
+		perCustomer[s.customer] += float64(s.allocated)
+		total += float64(s.allocated)
+	}
+
+	var withStreams []float64
+	for i, w := range perCustomer {
+		r.customers[i].weightSum += w
+		if w > 0 {
+			withStreams = append(withStreams, w)
+		}
+	}
+	if len(withStreams) > 0 {
+		r.jainSum += JainIndex(withStreams)
+		r.jainN++
+	}
+
+	r.samples++
+	if r.Limit > 0 {
+		util := total / float64(r.Limit)
+		r.utilSum += util
+		if util > r.utilMax {
+			r.utilMax = util
+		}
+	}
+}
+
+// JainIndex returns Jain's fairness index of xs, which is 1 when all values are equal
+// and 1/len(xs) when a single value takes everything.
+func JainIndex(xs []float64) float64 {
+	var sum, sumSq float64
+	for _, x := range xs {
+		sum += x
+		sumSq += x * x
+	}
+	if sumSq == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(xs)) * sumSq)
+}
+
+// Percentile returns the p-th percentile (0-100) of sorted, or zero if it is empty.
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// Write prints the report.
+func (r *Report) Write(w io.Writer) {
+	var requested, granted, denied int
+	for _, c := range r.customers {
+		requested += c.Requested
+		granted += c.Granted
+		denied += c.Denied
+	}
+	secs := r.Elapsed.Seconds()
+
+	latencies := append([]time.Duration(nil), r.latencies...)
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Fprintf(w, "Ran for %v.\n\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Throughput: %.1f UpdateStreams calls/s (%d calls, %d errors), %.1f streams requested/s, %.1f granted/s\n",
+		float64(r.Calls)/secs, r.Calls, r.Errors, float64(requested)/secs, float64(granted)/secs)
+	fmt.Fprintf(w, "Latency:    p50 %v, p90 %v, p99 %v, max %v\n",
+		Percentile(latencies, 50), Percentile(latencies, 90), Percentile(latencies, 99), Percentile(latencies, 100))
+	fmt.Fprintf(w, "Denials:    %d of %d streams (%.1f%%)\n", denied, requested, percent(denied, requested))
+	if r.Limit > 0 && r.samples > 0 {
+		fmt.Fprintf(w, "Utilization of limit %g: mean %.1f%%, max %.1f%%\n", r.Limit, 100*r.utilSum/float64(r.samples), 100*r.utilMax)
+	}
+
+	var means []float64
+	for _, c := range r.customers {
+		if c.Requested > 0 {
+			means = append(means, c.mean(r.samples))
+		}
+	}
+	if len(means) > 0 {
+		fmt.Fprintf(w, "Fairness:   Jain's index of mean allocation per customer %.3f", JainIndex(means))
+		if r.jainN > 0 {
+			fmt.Fprintf(w, ", mean instantaneous Jain's index %.3f", r.jainSum/float64(r.jainN))
+		}
+		fmt.Fprintf(w, "\n")
+	}
+
+	var totalMean float64
+	for _, m := range means {
+		totalMean += m
+	}
+	fmt.Fprintf(w, "\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "CUSTOMER\tREQUESTED\tGRANTED\tDENIED\tERRORS\tDENIAL %%\tMEAN WEIGHT\tSHARE %%\t\n")
+	for _, c := range r.customers {
+		mean := c.mean(r.samples)
+		share := 0.0
+		if totalMean > 0 {
+			share = 100 * mean / totalMean
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f\t%.2f\t%.1f\t\n",
+			c.Name, c.Requested, c.Granted, c.Denied, c.Errors, percent(c.Denied, c.Requested), mean, share)
+	}
+	tw.Flush()
+}
+
+func (c *CustomerStats) mean(samples int) float64 {
+	if samples == 0 {
+		return 0
+	}
+	return c.weightSum / float64(samples)
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
@@ -0,0 +1,85 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+type jsonPrinter struct {
+	w    io.Writer
+	step int
+}
+
+type jsonStep struct {
+	Step      int             `json:"step"`
+	Narration string          `json:"narration,omitempty"`
+	Request   json.RawMessage `json:"request"`
+	Response  json.RawMessage `json:"response"`
+}
+
+// Print writes the step's request and response in protojson form.
+func (p *jsonPrinter) Print(narration string, req *pb.UpdateStreamsRequest, res *pb.UpdateStreamsResponse) {
+	reqJSON, _ := protojson.Marshal(req)
+	resJSON, _ := protojson.Marshal(res)
+	out, _ := json.MarshalIndent(jsonStep{
+		Step:      p.step,
+		Narration: narration,
+		Request:   reqJSON,
+		Response:  resJSON,
+	}, "", "  ")
+	fmt.Fprintf(p.w, "%s\n", out)
+	p.step++
+}
+
+type ndjsonPrinter struct {
+	w       io.Writer
+	tracker *tracker
+	step    int
+}
+
+// Event is a single NDJSON line describing a stream touched by a step.
+type Event struct {
+	Time            time.Time `json:"time"`
+	Step            int       `json:"step"`
+	GuardName       string    `json:"guard_name"`
+	Environment     string    `json:"environment"`
+	StreamId        string    `json:"stream_id"`
+	Customer        string    `json:"customer,omitempty"`
+	Feature         string    `json:"feature,omitempty"`
+	PriorityBoost   int32     `json:"priority_boost,omitempty"`
+	MinWeight       float32   `json:"min_weight"`
+	MaxWeight       float32   `json:"max_weight"`
+	AllocatedWeight float32   `json:"allocated_weight"`
+	PreviousWeight  float32   `json:"previous_weight"`
+	Change          Change    `json:"change"`
+}
+
+// Print writes one event per stream that the step requested, ended or reallocated.
+func (p *ndjsonPrinter) Print(narration string, req *pb.UpdateStreamsRequest, res *pb.UpdateStreamsResponse) {
+	now := time.Now().UTC()
+	enc := json.NewEncoder(p.w)
+	for _, s := range p.tracker.apply(req, res) {
+		enc.Encode(Event{
+			Time:            now,
+			Step:            p.step,
+			GuardName:       req.GetGuardName(),
+			Environment:     req.GetEnvironment(),
+			StreamId:        s.StreamId,
+			Customer:        s.Customer,
+			Feature:         s.Feature,
+			PriorityBoost:   s.PriorityBoost,
+			MinWeight:       s.MinWeight,
+			MaxWeight:       s.MaxWeight,
+			AllocatedWeight: s.Allocated,
+			PreviousWeight:  s.Previous,
+			Change:          s.Change,
+		})
+	}
+	p.step++
+}
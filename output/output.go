@@ -0,0 +1,158 @@
+// Package output prints UpdateStreams requests and their results in a choice of formats:
+//
+//   - table: a human readable table of every known stream and how its allocation changed
+//   - json: the request and response of every step in protojson form
+//   - ndjson: one JSON event per line for every allocated or ended stream, for log pipelines
+package output
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Formats lists the supported output formats.
+var Formats = []string{"table", "json", "ndjson"}
+
+// CustomerTag is the tag shown in the customer column of tables and events.
+const CustomerTag = "customer_id"
+
+// Printer writes the outcome of UpdateStreams calls.
+type Printer interface {
+	// Print writes req and the response it received. Narration describes the step and may be empty.
+	Print(narration string, req *pb.UpdateStreamsRequest, res *pb.UpdateStreamsResponse)
+}
+
+// New returns a Printer for the named format which writes to w.
+func New(format string, w io.Writer) (Printer, error) {
+	switch format {
+	case "table":
+		return &tablePrinter{w: w, tracker: newTracker(), color: isTerminal(w)}, nil
+	case "json":
+		return &jsonPrinter{w: w}, nil
+	case "ndjson":
+		return &ndjsonPrinter{w: w, tracker: newTracker()}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q, must be one of %s", format, strings.Join(Formats, ", "))
+	}
+}
+
+// isTerminal reports whether w is a terminal, so that tables are only coloured for people and never for files
+// or pipes. NO_COLOR (https://no-color.org) turns colour off everywhere.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Change describes how a stream's allocation moved between two steps.
+type Change string
+
+const (
+	Unchanged Change = "unchanged"
+	Added     Change = "added"
+	Upsized   Change = "upsized"
+	Downsized Change = "downsized"
+	Ended     Change = "ended"
+)
+
+// Stream is the last known state of a stream.
+type Stream struct {
+	StreamId      string
+	Customer      string
+	Feature       string
+	PriorityBoost int32
+	MinWeight     float32
+	MaxWeight     float32
+	Allocated     float32
+	Previous      float32 // allocation before the most recent step
+	Change        Change
+}
+
+// tracker follows the state of every stream across steps, so that changes can be reported.
+type tracker struct {
+	streams map[string]*Stream
+}
+
+func newTracker() *tracker {
+	return &tracker{streams: make(map[string]*Stream)}
+}
+
+// apply records a step and returns the streams it touched, in stream ID order.
+// Streams present in res but never requested through this tracker are included
+// with what little is known about them.
+func (t *tracker) apply(req *pb.UpdateStreamsRequest, res *pb.UpdateStreamsResponse) []*Stream {
+	touched := make(map[string]*Stream)
+	for _, s := range t.streams {
+		s.Previous = s.Allocated
+		s.Change = Unchanged
+	}
+
+	for _, r := range req.GetRequests() {
+		s := &Stream{
+			StreamId:      r.GetStreamId(),
+			Feature:       r.GetFeature(),
+			PriorityBoost: r.GetPriorityBoost(),
+			MinWeight:     r.GetMinWeight(),
+			MaxWeight:     r.GetMaxWeight(),
+			Change:        Added,
+		}
+		for _, tag := range r.GetTags() {
+			if tag.GetKey() == CustomerTag {
+				s.Customer = tag.GetValue()
+			}
+		}
+		if old, ok := t.streams[s.StreamId]; ok {
+			s.Previous, s.Allocated, s.Change = old.Allocated, old.Allocated, Unchanged
+		}
+		t.streams[s.StreamId] = s
+		touched[s.StreamId] = s
+	}
+	for _, id := range req.GetEnded() {
+		if s, ok := t.streams[id]; ok {
+			s.Allocated = 0
+			s.Change = Ended
+			touched[id] = s
+			delete(t.streams, id)
+		}
+	}
+	for _, r := range res.GetResults() {
+		s, ok := t.streams[r.GetStreamId()]
+		if !ok {
+			s = &Stream{StreamId: r.GetStreamId(), Change: Added}
+			t.streams[s.StreamId] = s
+		}
+		s.Allocated = r.GetAllocatedWeight()
+		if s.Change != Added {
+			switch {
+			case s.Allocated > s.Previous:
+				s.Change = Upsized
+			case s.Allocated < s.Previous:
+				s.Change = Downsized
+			}
+		}
+		touched[s.StreamId] = s
+	}
+	return sorted(touched)
+}
+
+// all returns every stream still known to the tracker, in stream ID order.
+func (t *tracker) all() []*Stream {
+	return sorted(t.streams)
+}
+
+func sorted(m map[string]*Stream) []*Stream {
+	streams := make([]*Stream, 0, len(m))
+	for _, s := range m {
+		streams = append(streams, s)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].StreamId < streams[j].StreamId })
+	return streams
+}
@@ -0,0 +1,68 @@
+package output
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+const (
+	colorReset = "\033[0m"
+	colorGreen = "\033[32m"
+	colorRed   = "\033[31m"
+)
+
+type tablePrinter struct {
+	w       io.Writer
+	tracker *tracker
+	color   bool // highlight changes with ANSI colours
+}
+
+// Print writes every stream still known after the step, highlighting upsized and downsized streams,
+// followed by the streams the step ended.
+func (p *tablePrinter) Print(narration string, req *pb.UpdateStreamsRequest, res *pb.UpdateStreamsResponse) {
+	touched := p.tracker.apply(req, res)
+
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "STREAM\tCUSTOMER\tREQUESTED\tALLOCATED\tCHANGE\n")
+	for _, s := range p.tracker.all() {
+		fmt.Fprintf(tw, "%s\t%s\t%g-%g\t%g\t%s\n", s.StreamId, orDash(s.Customer), s.MinWeight, s.MaxWeight, s.Allocated, p.formatChange(s))
+	}
+	tw.Flush()
+
+	for _, s := range touched {
+		if s.Change == Ended {
+			fmt.Fprintf(p.w, "ended: %s\n", s.StreamId)
+		}
+	}
+	fmt.Fprintf(p.w, "\n")
+}
+
+func (p *tablePrinter) formatChange(s *Stream) string {
+	switch s.Change {
+	case Upsized:
+		return p.colorize(colorGreen, fmt.Sprintf("▲ %+g", s.Allocated-s.Previous))
+	case Downsized:
+		return p.colorize(colorRed, fmt.Sprintf("▼ %+g", s.Allocated-s.Previous))
+	case Added:
+		return "added"
+	default:
+		return ""
+	}
+}
+
+func (p *tablePrinter) colorize(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+// Package repl implements an interactive session for exploring a Stream Balancer Guard.
+//
+// Each command issues an UpdateStreams call, whose outcome is printed by the SendFunc:
+//
+//	add <id> [min=1] [max=20] [boost=N] [feature=name] [tag=value ...]
+//	end <id> [<id> ...]
+//	list
+//	history
+//	reset
+//	help
+//	quit
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// SendFunc issues and prints a single UpdateStreams call. The command line is passed as narration.
+type SendFunc func(narration string, reqs []*pb.StreamRequest, ended []string) (*pb.UpdateStreamsResponse, error)
+
+const help = `Commands:
+  add <id> [min=1] [max=20] [boost=N] [feature=name] [tag=value ...]
+                  request a new stream; any other key=value pair is sent as a tag
+  end <id> ...    mark streams as ended
+  list            refresh and show all streams known to this session
+  history         show the commands issued in this session
+  reset           end every stream known to this session and start over
+  help            show this message
+  quit            leave the session
+`
+
+// Session holds the streams created interactively and the commands issued so far.
+type Session struct {
+	send    SendFunc
+	out     io.Writer
+	streams map[string]bool
+	history []string
+}
+
+// New returns a Session which issues requests with send and writes to out.
+func New(send SendFunc, out io.Writer) *Session {
+	return &Session{
+		send:    send,
+		out:     out,
+		streams: make(map[string]bool),
+	}
+}
+
+// Run reads commands from in until it is exhausted or the user quits.
+func (s *Session) Run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	fmt.Fprintf(s.out, "Type \"help\" for a list of commands.\n> ")
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if line != "" {
+			if err := s.Exec(line); err != nil {
+				fmt.Fprintf(s.out, "error: %v\n", err)
+			}
+		}
+		fmt.Fprintf(s.out, "> ")
+	}
+	return scanner.Err()
+}
+
+// Exec runs a single command line.
+func (s *Session) Exec(line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case "add":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: add <id> [min=1] [max=20] [boost=N] [feature=name] [tag=value ...]")
+		}
+		req, err := parseAdd(fields[1], fields[2:])
+		if err != nil {
+			return err
+		}
+		return s.update(line, []*pb.StreamRequest{req}, nil)
+	case "end":
+		if len(fields) < 2 {
+			return fmt.Errorf("usage: end <id> [<id> ...]")
+		}
+		return s.update(line, nil, fields[1:])
+	case "list":
+		return s.update(line, nil, nil)
+	case "history":
+		for i, h := range s.history {
+			fmt.Fprintf(s.out, "%3d  %s\n", i+1, h)
+		}
+		return nil
+	case "reset":
+		ids := s.ids()
+		if len(ids) > 0 {
+			if err := s.update(line, nil, ids); err != nil {
+				return err
+			}
+		}
+		s.streams = make(map[string]bool)
+		s.history = nil
+		fmt.Fprintf(s.out, "Session reset.\n")
+		return nil
+	case "help":
+		fmt.Fprint(s.out, help)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, type \"help\" for a list of commands", fields[0])
+	}
+}
+
+func (s *Session) update(line string, reqs []*pb.StreamRequest, ended []string) error {
+	if _, err := s.send(line, reqs, ended); err != nil {
+		return err
+	}
+	s.history = append(s.history, line)
+
+	for _, req := range reqs {
+		s.streams[req.StreamId] = true
+	}
+	for _, id := range ended {
+		delete(s.streams, id)
+	}
+	return nil
+}
+
+func (s *Session) ids() []string {
+	ids := make([]string, 0, len(s.streams))
+	for id := range s.streams {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func parseAdd(id string, args []string) (*pb.StreamRequest, error) {
+	req := &pb.StreamRequest{
+		StreamId:  id,
+		MinWeight: 1,
+		MaxWeight: 20,
+	}
+	for _, arg := range args {
+		k, v, ok := strings.Cut(arg, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", arg)
+		}
+		switch k {
+		case "min", "max":
+			f, err := strconv.ParseFloat(v, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			if k == "min" {
+				req.MinWeight = float32(f)
+			} else {
+				req.MaxWeight = float32(f)
+			}
+		case "boost":
+			b, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("boost: %w", err)
+			}
+			boost := int32(b)
+			req.PriorityBoost = &boost
+		case "feature":
+			req.Feature = v
+		default:
+			req.Tags = append(req.Tags, &pb.Tag{Key: k, Value: v})
+		}
+	}
+	if req.MinWeight > req.MaxWeight {
+		return nil, fmt.Errorf("min (%g) is greater than max (%g)", req.MinWeight, req.MaxWeight)
+	}
+	return req, nil
+}
@@ -0,0 +1,205 @@
+// Package replay re-issues recorded UpdateStreams traffic against a hub and reports
+// where the new allocations diverge from the recorded ones.
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/streams"
+)
+
+// Sender issues an UpdateStreamsRequest as is. It is satisfied by *streams.Client.
+type Sender interface {
+	Send(ctx context.Context, req *pb.UpdateStreamsRequest) (*pb.UpdateStreamsResponse, error)
+}
+
+// Options control how records are replayed.
+type Options struct {
+	// Speed scales the original gaps between calls: 1 keeps the recorded timing, 2 replays twice
+	// as fast, and 0 sends every call as soon as the previous one has completed.
+	Speed float64
+	// Tolerance is the allowed difference between recorded and replayed weights.
+	Tolerance float32
+	// GuardName and Environment, if set, replace the ones in the recorded requests.
+	GuardName   string
+	Environment string
+}
+
+// Divergence is a stream whose replayed allocation differs from the recorded one.
+type Divergence struct {
+	StreamId string
+	Recorded float32
+	Replayed float32
+	// Missing is "recorded" or "replayed" if the stream was absent from that response.
+	Missing string
+}
+
+// Summary counts what happened during a replay.
+type Summary struct {
+	Calls             int
+	DivergedCalls     int
+	DivergedStreams   int
+	ErrorsRecorded    int // calls which failed when recorded
+	ErrorsReplayed    int // calls which failed when replayed
+	ErrorMismatches   int // calls which failed in only one of the recording and the replay
+	StreamsDivergedBy map[string]int
+}
+
+// Run replays recs through s, writing every divergence to out.
+func Run(ctx context.Context, s Sender, recs []*streams.Record, opts Options, out io.Writer) (*Summary, error) {
+	sum := &Summary{StreamsDivergedBy: make(map[string]int)}
+	if len(recs) == 0 {
+		return sum, nil
+	}
+
+	first := recs[0].Time
+	start := time.Now()
+	for i, rec := range recs {
+		if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(first)) / opts.Speed))
+			select {
+			case <-ctx.Done():
+				return sum, ctx.Err()
+			case <-time.After(time.Until(due)):
+			}
+		}
+
+		req := rec.Request
+		if opts.GuardName != "" || opts.Environment != "" {
+			req = &pb.UpdateStreamsRequest{
+				GuardName:   rec.Request.GetGuardName(),
+				Environment: rec.Request.GetEnvironment(),
+				Requests:    rec.Request.GetRequests(),
+				Ended:       rec.Request.GetEnded(),
+			}
+			if opts.GuardName != "" {
+				req.GuardName = opts.GuardName
+			}
+			if opts.Environment != "" {
+				req.Environment = opts.Environment
+			}
+		}
+
+		res, err := s.Send(ctx, req)
+		if ctx.Err() != nil {
+			return sum, ctx.Err()
+		}
+		sum.Calls++
+		offset := rec.Time.Sub(first).Round(time.Millisecond)
+
+		if rec.Error != "" {
+			sum.ErrorsRecorded++
+		}
+		if err != nil {
+			sum.ErrorsReplayed++
+		}
+		if (rec.Error != "") != (err != nil) {
+			sum.ErrorMismatches++
+			fmt.Fprintf(out, "call %d at +%v: recorded error %q, replayed error %v\n\n", i, offset, rec.Error, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if divs := Compare(rec.Response, res, opts.Tolerance); len(divs) > 0 {
+			sum.DivergedCalls++
+			sum.DivergedStreams += len(divs)
+			for _, d := range divs {
+				sum.StreamsDivergedBy[d.StreamId]++
+			}
+			fmt.Fprintf(out, "call %d at +%v: %d stream(s) diverged\n", i, offset, len(divs))
+			WriteDivergences(out, divs)
+			fmt.Fprintf(out, "\n")
+		}
+	}
+	return sum, nil
+}
+
+// Compare returns the streams whose allocations differ by more than tolerance between
+// the recorded and replayed responses, sorted by stream ID.
+func Compare(recorded, replayed *pb.UpdateStreamsResponse, tolerance float32) []Divergence {
+	rec := weights(recorded)
+	rep := weights(replayed)
+
+	var divs []Divergence
+	for id, rw := range rec {
+		pw, ok := rep[id]
+		switch {
+		case !ok:
+			divs = append(divs, Divergence{StreamId: id, Recorded: rw, Missing: "replayed"})
+		case rw-pw > tolerance || pw-rw > tolerance:
+			divs = append(divs, Divergence{StreamId: id, Recorded: rw, Replayed: pw})
+		}
+	}
+	for id, pw := range rep {
+		if _, ok := rec[id]; !ok {
+			divs = append(divs, Divergence{StreamId: id, Replayed: pw, Missing: "recorded"})
+		}
+	}
+	sort.Slice(divs, func(i, j int) bool { return divs[i].StreamId < divs[j].StreamId })
+	return divs
+}
+
+func weights(res *pb.UpdateStreamsResponse) map[string]float32 {
+	w := make(map[string]float32, len(res.GetResults()))
+	for _, r := range res.GetResults() {
+		w[r.GetStreamId()] = r.GetAllocatedWeight()
+	}
+	return w
+}
+
+// WriteDivergences prints divs as a table of recorded and replayed weights.
+func WriteDivergences(w io.Writer, divs []Divergence) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "stream\trecorded\treplayed\t\n")
+	for _, d := range divs {
+		recorded, replayed := fmt.Sprintf("%.3f", d.Recorded), fmt.Sprintf("%.3f", d.Replayed)
+		switch d.Missing {
+		case "recorded":
+			recorded = "(missing)"
+		case "replayed":
+			replayed = "(missing)"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", d.StreamId, recorded, replayed)
+	}
+	tw.Flush()
+}
+
+// Write prints the summary.
+func (s *Summary) Write(w io.Writer) {
+	fmt.Fprintf(w, "Replayed %d calls: %d diverged (%d stream allocations).\n", s.Calls, s.DivergedCalls, s.DivergedStreams)
+	fmt.Fprintf(w, "Errors: %d recorded, %d replayed, %d calls failed in only one of them.\n", s.ErrorsRecorded, s.ErrorsReplayed, s.ErrorMismatches)
+	if len(s.StreamsDivergedBy) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(s.StreamsDivergedBy))
+	for id := range s.StreamsDivergedBy {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if s.StreamsDivergedBy[ids[i]] != s.StreamsDivergedBy[ids[j]] {
+			return s.StreamsDivergedBy[ids[i]] > s.StreamsDivergedBy[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	if len(ids) > 10 {
+		ids = ids[:10]
+	}
+	fmt.Fprintf(w, "Streams that diverged most often:\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "  %s: %d calls\n", id, s.StreamsDivergedBy[id])
+	}
+}
+
+// Diverged reports whether the replay differed from the recording at all.
+func (s *Summary) Diverged() bool {
+	return s.DivergedCalls > 0 || s.ErrorMismatches > 0
+}
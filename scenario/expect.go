@@ -0,0 +1,64 @@
+package scenario
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// DefaultTolerance is the allowed difference between expected and allocated weights
+// when neither the scenario nor the step sets a tolerance.
+const DefaultTolerance = 0.01
+
+// Mismatch describes a stream whose allocated weight did not match the step's expectation.
+type Mismatch struct {
+	StreamId string
+	Expected float32
+	Actual   float32
+	Missing  bool // the stream was not present in the response
+}
+
+// Check compares the allocations in res against the weights the step expects.
+// Streams absent from res are treated as unallocated, so an expectation of zero matches them.
+// Mismatches are returned sorted by stream ID.
+func (s *Step) Check(res *pb.UpdateStreamsResponse, tolerance float32) []Mismatch {
+	if s.Tolerance > 0 {
+		tolerance = s.Tolerance
+	}
+
+	allocated := make(map[string]float32, len(res.GetResults()))
+	for _, r := range res.GetResults() {
+		allocated[r.GetStreamId()] = r.GetAllocatedWeight()
+	}
+
+	var mismatches []Mismatch
+	for id, want := range s.Expect {
+		got, ok := allocated[id]
+		if !ok && want != 0 {
+			mismatches = append(mismatches, Mismatch{StreamId: id, Expected: want, Missing: true})
+			continue
+		}
+		if diff := got - want; diff > tolerance || diff < -tolerance {
+			mismatches = append(mismatches, Mismatch{StreamId: id, Expected: want, Actual: got})
+		}
+	}
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].StreamId < mismatches[j].StreamId })
+	return mismatches
+}
+
+// WriteDiff prints mismatches as a table of expected and actual weights.
+func WriteDiff(w io.Writer, mismatches []Mismatch) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "stream\texpected\tactual\t\n")
+	for _, m := range mismatches {
+		actual := fmt.Sprintf("%.3f", m.Actual)
+		if m.Missing {
+			actual = "(missing)"
+		}
+		fmt.Fprintf(tw, "%s\t%.3f\t%s\t\n", m.StreamId, m.Expected, actual)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,148 @@
+// Package scenario loads declarative Stream Balancer demo scenarios.
+//
+// A scenario file is JSON. Each step carries narration, the streams to add
+// (StreamRequest messages in protojson form), the IDs of streams to end and
+// an optional pause. Steps may also declare the weight each stream is expected to
+// be allocated once the step has run, for example:
+//
+//	{
+//	  "name": "my-scenario",
+//	  "guard_name": "Stream Balancer Quota",
+//	  "environment": "sb_quota",
+//	  "tolerance": 0.5,
+//	  "steps": [
+//	    {
+//	      "narration": "Request one stream for customer1.",
+//	      "add": [{"streamId": "s1", "minWeight": 1, "maxWeight": 20, "tags": [{"key": "customer_id", "value": "customer1"}]}],
+//	      "pause": "2s",
+//	      "expect": {"s1": 15}
+//	    },
+//	    {"narration": "End it again.", "end": ["s1"]}
+//	  ]
+//	}
+//
+// YAML is not supported, to avoid taking on a YAML dependency; convert YAML scenarios to JSON first.
+package scenario
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+//go:embed default.json
+var defaultScenario []byte
+
+// Scenario is a sequence of UpdateStreams calls against a single Guard.
+type Scenario struct {
+	Name        string
+	Intro       string // printed once before the first step
+	GuardName   string
+	Environment string
+	Tolerance   float32 // allowed difference from expected weights; DefaultTolerance if unset
+	Steps       []*Step
+}
+
+// Step is a single UpdateStreams call, with the commentary printed before it.
+type Step struct {
+	Narration string
+	Add       []*pb.StreamRequest
+	End       []string
+	Pause     time.Duration      // how long to wait after the step has run
+	Expect    map[string]float32 // expected AllocatedWeight by stream ID
+	Tolerance float32            // overrides the scenario tolerance if set
+}
+
+type scenarioJSON struct {
+	Name        string      `json:"name"`
+	Intro       string      `json:"intro"`
+	GuardName   string      `json:"guard_name"`
+	Environment string      `json:"environment"`
+	Tolerance   float32     `json:"tolerance"`
+	Steps       []*stepJSON `json:"steps"`
+}
+
+type stepJSON struct {
+	Narration string             `json:"narration"`
+	Add       []json.RawMessage  `json:"add"`
+	End       []string           `json:"end"`
+	Pause     string             `json:"pause"`
+	Expect    map[string]float32 `json:"expect"`
+	Tolerance float32            `json:"tolerance"`
+}
+
+// Default returns the walkthrough scenario shipped with the demo.
+func Default() (*Scenario, error) {
+	return Parse(defaultScenario)
+}
+
+// Load reads and parses the scenario file at path.
+func Load(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Parse parses a JSON scenario. Unknown keys are an error, so that a misspelt expectation can't be silently ignored.
+func Parse(data []byte) (*Scenario, error) {
+	var sj scenarioJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sj); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the scenario")
+	}
+
+	s := &Scenario{
+		Name:        sj.Name,
+		Intro:       sj.Intro,
+		GuardName:   sj.GuardName,
+		Environment: sj.Environment,
+		Tolerance:   sj.Tolerance,
+	}
+	if s.Tolerance <= 0 {
+		s.Tolerance = DefaultTolerance
+	}
+	for i, stj := range sj.Steps {
+		step := &Step{
+			Narration: stj.Narration,
+			End:       stj.End,
+			Expect:    stj.Expect,
+			Tolerance: stj.Tolerance,
+		}
+		for j, raw := range stj.Add {
+			req := &pb.StreamRequest{}
+			if err := protojson.Unmarshal(raw, req); err != nil {
+				return nil, fmt.Errorf("step %d: add %d: %w", i, j, err)
+			}
+			if req.StreamId == "" {
+				return nil, fmt.Errorf("step %d: add %d: missing streamId", i, j)
+			}
+			step.Add = append(step.Add, req)
+		}
+		if stj.Pause != "" {
+			d, err := time.ParseDuration(stj.Pause)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: pause: %w", i, err)
+			}
+			step.Pause = d
+		}
+		s.Steps = append(s.Steps, step)
+	}
+	return s, nil
+}
@@ -0,0 +1,170 @@
+package sentinel
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// The enums below have the same values as in sentinel-golang, whose JSON encodes them as integers.
+
+// TokenCalculateStrategy is how a flow rule's threshold is calculated.
+type TokenCalculateStrategy int
+
+const (
+	Direct         TokenCalculateStrategy = iota
+	WarmUp                                // evaluated as Direct
+	MemoryAdaptive                        // evaluated as Direct
+)
+
+// ControlBehavior is what a flow rule does with requests over its threshold.
+type ControlBehavior int
+
+const (
+	Reject     ControlBehavior = iota // block requests over the threshold
+	Throttling                        // space requests out evenly, queueing them for up to MaxQueueingTimeMs
+)
+
+// RelationStrategy is which resource's traffic a flow rule counts.
+type RelationStrategy int
+
+const (
+	CurrentResource    RelationStrategy = iota
+	AssociatedResource                  // count RefResource, and block Resource when it is over the threshold
+)
+
+// FlowRule limits the number of requests to a resource in each StatIntervalInMs.
+type FlowRule struct {
+	ID                     string                 `json:"id,omitempty"`
+	Resource               string                 `json:"resource"`
+	TokenCalculateStrategy TokenCalculateStrategy `json:"tokenCalculateStrategy"`
+	ControlBehavior        ControlBehavior        `json:"controlBehavior"`
+	Threshold              float64                `json:"threshold"`
+	RelationStrategy       RelationStrategy       `json:"relationStrategy"`
+	RefResource            string                 `json:"refResource"`
+	MaxQueueingTimeMs      uint32                 `json:"maxQueueingTimeMs"`
+	WarmUpPeriodSec        uint32                 `json:"warmUpPeriodSec"`
+	WarmUpColdFactor       uint32                 `json:"warmUpColdFactor"`
+	StatIntervalInMs       uint32                 `json:"statIntervalInMs"` // 1000 if unset, making Threshold a QPS
+}
+
+// statResource is the resource whose traffic the rule counts.
+func (r *FlowRule) statResource() string {
+	if r.RelationStrategy == AssociatedResource {
+		return r.RefResource
+	}
+	return r.Resource
+}
+
+func (r *FlowRule) interval() time.Duration {
+	if r.StatIntervalInMs == 0 {
+		return time.Second
+	}
+	return time.Duration(r.StatIntervalInMs) * time.Millisecond
+}
+
+// IsolationMetricType is what an isolation rule limits.
+type IsolationMetricType int
+
+const (
+	Concurrency IsolationMetricType = iota
+)
+
+// IsolationRule limits the number of requests to a resource in flight at once.
+type IsolationRule struct {
+	ID         string              `json:"id,omitempty"`
+	Resource   string              `json:"resource"`
+	MetricType IsolationMetricType `json:"metricType"`
+	Threshold  uint32              `json:"threshold"`
+}
+
+// SystemMetricType is what a system rule limits.
+type SystemMetricType int
+
+const (
+	Load              SystemMetricType = iota // one minute load average
+	AvgRT                                     // average response time in milliseconds over the last second
+	SystemConcurrency                         // requests in flight across every resource
+	InboundQPS                                // requests across every resource over the last second
+	CPUUsage                                  // CPU usage, from 0 to 1
+)
+
+// AdaptiveStrategy is how a system rule adapts to load.
+type AdaptiveStrategy int
+
+const (
+	NoAdaptive AdaptiveStrategy = iota
+	BBR                         // evaluated as NoAdaptive
+)
+
+// SystemRule protects the whole service, blocking requests to every resource while a metric is over TriggerCount.
+type SystemRule struct {
+	ID           string           `json:"id,omitempty"`
+	MetricType   SystemMetricType `json:"metricType"`
+	TriggerCount float64          `json:"triggerCount"`
+	Strategy     AdaptiveStrategy `json:"strategy"`
+}
+
+// Rules are the locally evaluated rules of a SentinelConfig. Circuit breaker rules are handled by the circuitbreaker package.
+type Rules struct {
+	Flow      []FlowRule
+	Isolation []IsolationRule
+	System    []SystemRule
+}
+
+// Empty reports whether there are no rules.
+func (r *Rules) Empty() bool {
+	return len(r.Flow) == 0 && len(r.Isolation) == 0 && len(r.System) == 0
+}
+
+// Parse decodes the flow, isolation and system rules of cfg, which may be nil. Each is a JSON array in sentinel-golang's format.
+func Parse(cfg *pb.SentinelConfig) (*Rules, error) {
+	rules := &Rules{}
+	if err := decode("flow", cfg.GetFlowRulesJson(), &rules.Flow); err != nil {
+		return nil, err
+	}
+	if err := decode("isolation", cfg.GetIsolationRulesJson(), &rules.Isolation); err != nil {
+		return nil, err
+	}
+	if err := decode("system", cfg.GetSystemRulesJson(), &rules.System); err != nil {
+		return nil, err
+	}
+	for _, r := range rules.Flow {
+		switch {
+		case r.Resource == "":
+			return nil, fmt.Errorf("flow rule %q has no resource", r.ID)
+		case r.Threshold < 0:
+			return nil, fmt.Errorf("flow rule %q for %s has a negative threshold", r.ID, r.Resource)
+		case r.RelationStrategy == AssociatedResource && r.RefResource == "":
+			return nil, fmt.Errorf("flow rule %q for %s has no refResource", r.ID, r.Resource)
+		case r.ControlBehavior != Reject && r.ControlBehavior != Throttling:
+			return nil, fmt.Errorf("flow rule %q for %s has unknown controlBehavior %d", r.ID, r.Resource, r.ControlBehavior)
+		}
+	}
+	for _, r := range rules.Isolation {
+		switch {
+		case r.Resource == "":
+			return nil, fmt.Errorf("isolation rule %q has no resource", r.ID)
+		case r.MetricType != Concurrency:
+			return nil, fmt.Errorf("isolation rule %q for %s has unknown metricType %d", r.ID, r.Resource, r.MetricType)
+		}
+	}
+	for _, r := range rules.System {
+		if r.MetricType < Load || r.MetricType > CPUUsage {
+			return nil, fmt.Errorf("system rule %q has unknown metricType %d", r.ID, r.MetricType)
+		}
+	}
+	return rules, nil
+}
+
+func decode(kind, data string, v any) error {
+	if data == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		return fmt.Errorf("parsing %s rules: %w", kind, err)
+	}
+	return nil
+}
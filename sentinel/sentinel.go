@@ -0,0 +1,381 @@
+// Package sentinel evaluates the Sentinel flow, isolation and system rules from a service's SentinelConfig
+// locally, without calling the hub. Rules name the Sentinel resources they apply to, which are Guard names.
+//
+// A Limiter is loaded with the rules from GetServiceConfig, usually by a serviceconfig.Watcher, and its Evaluator
+// plugs into a guard.Guard, where the outcome is its Local status: LOCAL_ALLOWED or LOCAL_BLOCKED, LOCAL_EVAL_DISABLED
+// if no rules apply to the resource, or LOCAL_ERROR if system metrics could not be read.
+package sentinel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+	"github.com/StanzaSystems/stream-demo/guard"
+)
+
+// DefaultSystemRefresh is how often system metrics are sampled if WithSystemStats is not given an interval.
+const DefaultSystemRefresh = time.Second
+
+// Limiter enforces Sentinel rules for every resource in a service. It is safe for concurrent use.
+type Limiter struct {
+	systemStats   func() (SystemStats, error)
+	systemRefresh time.Duration
+	now           func() time.Time
+	wait          func(ctx context.Context, d time.Duration) error // until a Throttling turn
+
+	mu        sync.Mutex
+	rules     *Rules
+	flow      map[string][]*flowRule // by resource
+	isolation map[string][]IsolationRule
+	resources map[string]*resource
+
+	// Service-wide metrics for system rules.
+	inbound     *window
+	rt          *window // total response time in milliseconds
+	completed   *window
+	concurrency int
+	system      SystemStats
+	systemErr   error
+	sampled     time.Time
+	sampling    bool
+}
+
+type flowRule struct {
+	FlowRule
+	lastPassed time.Time // for Throttling
+}
+
+// resource holds a resource's metrics: requests passed in each interval its flow rules count over,
+// and requests in flight.
+type resource struct {
+	passed      map[time.Duration]*window
+	concurrency int
+}
+
+// Option configures a Limiter.
+type Option func(*Limiter)
+
+// WithSystemStats samples the metrics for Load and CPUUsage system rules with f, at most once per refresh.
+// By default they are read from /proc with ProcStats.
+func WithSystemStats(f func() (SystemStats, error), refresh time.Duration) Option {
+	return func(l *Limiter) {
+		l.systemStats, l.systemRefresh = f, refresh
+	}
+}
+
+// New returns a Limiter with no rules, which allows everything until Update is called.
+func New(opts ...Option) *Limiter {
+	l := &Limiter{
+		systemStats:   ProcStats(),
+		systemRefresh: DefaultSystemRefresh,
+		now:           time.Now,
+		wait:          wait,
+		rules:         &Rules{},
+		resources:     make(map[string]*resource),
+		inbound:       newWindow(time.Second),
+		rt:            newWindow(time.Second),
+		completed:     newWindow(time.Second),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Update replaces the rules with those in cfg; if cfg can't be parsed, the current rules are kept. Metrics, and the
+// turns of Throttling flow rules which are unchanged, are kept, so limits carry on smoothly across updates.
+func (l *Limiter) Update(cfg *pb.SentinelConfig) error {
+	rules, err := Parse(cfg)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rules = rules
+	old := make(map[FlowRule]*flowRule)
+	for _, rs := range l.flow {
+		for _, r := range rs {
+			old[r.FlowRule] = r
+		}
+	}
+	l.flow = make(map[string][]*flowRule)
+	for _, r := range rules.Flow {
+		fr := old[r]
+		if fr == nil {
+			fr = &flowRule{FlowRule: r}
+		}
+		l.flow[r.Resource] = append(l.flow[r.Resource], fr)
+		res := l.resource(r.statResource())
+		if res.passed[r.interval()] == nil {
+			res.passed[r.interval()] = newWindow(r.interval())
+		}
+	}
+	l.isolation = make(map[string][]IsolationRule)
+	for _, r := range rules.Isolation {
+		l.isolation[r.Resource] = append(l.isolation[r.Resource], r)
+	}
+	return nil
+}
+
+// Updater returns a function for serviceconfig.WithChange which updates the rules from every new version of the
+// service config, calling onErr, if it is set, when they can't be parsed.
+func (l *Limiter) Updater(onErr func(error)) func(version string, cfg *pb.ServiceConfig) {
+	return func(version string, cfg *pb.ServiceConfig) {
+		if err := l.Update(cfg.GetSentinelConfig()); err != nil && onErr != nil {
+			onErr(fmt.Errorf("service config %s: %w", version, err))
+		}
+	}
+}
+
+// Rules returns the rules being enforced.
+func (l *Limiter) Rules() *Rules {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rules
+}
+
+func (l *Limiter) resource(name string) *resource {
+	res := l.resources[name]
+	if res == nil {
+		res = &resource{passed: make(map[time.Duration]*window)}
+		l.resources[name] = res
+	}
+	return res
+}
+
+// Entry is a request admitted to a resource.
+type Entry struct {
+	l        *Limiter
+	resource *resource
+	start    time.Time
+	once     sync.Once
+}
+
+// Exit records that the request has finished. err is only used to tell requests which were blocked by a later
+// check, with guard.ErrBlocked, from those which ran; their response times are left out of AvgRT.
+func (e *Entry) Exit(err error) {
+	e.once.Do(func() {
+		now := e.l.now()
+		e.l.mu.Lock()
+		defer e.l.mu.Unlock()
+		e.resource.concurrency--
+		e.l.concurrency--
+		if !errors.Is(err, guard.ErrBlocked) {
+			e.l.rt.add(now, float64(now.Sub(e.start))/float64(time.Millisecond))
+			e.l.completed.add(now, 1)
+		}
+	})
+}
+
+// Entry checks a request to the named resource against the rules. Unless it is blocked or there is an error,
+// it returns an Entry whose Exit must be called when the request has finished. Requests to resources with
+// Throttling flow rules may wait for their turn, for up to the rule's MaxQueueingTimeMs or until ctx is done.
+func (l *Limiter) Entry(ctx context.Context, name string) (pb.Local, *Entry) {
+	l.sample()
+	l.mu.Lock()
+	now := l.now()
+	res := l.resource(name)
+	evaluated := len(l.rules.System) > 0 || len(l.flow[name]) > 0 || len(l.isolation[name]) > 0
+
+	local := l.checkSystem(now)
+	if local == pb.Local_LOCAL_ALLOWED {
+		local = l.checkResource(now, name, res)
+	}
+	var wait time.Duration
+	var turn []reservation
+	if local == pb.Local_LOCAL_ALLOWED {
+		wait, turn, local = l.throttle(now, name)
+	}
+	if local != pb.Local_LOCAL_ALLOWED {
+		l.mu.Unlock()
+		return local, nil
+	}
+	// The request is counted along with the checks, so that concurrent requests can't all pass them.
+	l.pass(now, res, 1)
+	res.concurrency++
+	l.concurrency++
+	l.mu.Unlock()
+
+	e := &Entry{l: l, resource: res, start: now}
+	if wait > 0 {
+		if err := l.wait(ctx, wait); err != nil {
+			l.cancel(now, res, turn)
+			e.Exit(guard.ErrBlocked)
+			return pb.Local_LOCAL_BLOCKED, nil
+		}
+		e.start = l.now()
+	}
+	if !evaluated {
+		return pb.Local_LOCAL_EVAL_DISABLED, e
+	}
+	return pb.Local_LOCAL_ALLOWED, e
+}
+
+// pass counts n requests to a resource passed at now. l.mu must be held.
+func (l *Limiter) pass(now time.Time, res *resource, n float64) {
+	for _, w := range res.passed {
+		w.add(now, n)
+	}
+	l.inbound.add(now, n)
+}
+
+// wait waits for d, or until ctx is done.
+func wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// sample reads the system metrics, if system rules use them and they are more than systemRefresh old. They are
+// read without holding l.mu, as that can be slow, and by one request at a time once there is a sample to go on.
+func (l *Limiter) sample() {
+	l.mu.Lock()
+	now := l.now()
+	due := false
+	for _, r := range l.rules.System {
+		if r.MetricType == Load || r.MetricType == CPUUsage {
+			due = now.Sub(l.sampled) >= l.systemRefresh && (!l.sampling || l.sampled.IsZero())
+			break
+		}
+	}
+	if due {
+		l.sampling = true
+	}
+	l.mu.Unlock()
+	if !due {
+		return
+	}
+
+	stats, err := l.systemStats()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.system, l.systemErr, l.sampled, l.sampling = stats, err, now, false
+}
+
+// checkSystem evaluates the system rules. l.mu must be held.
+func (l *Limiter) checkSystem(now time.Time) pb.Local {
+	for _, r := range l.rules.System {
+		var value float64
+		switch r.MetricType {
+		case Load, CPUUsage:
+			if l.systemErr != nil {
+				return pb.Local_LOCAL_ERROR
+			}
+			value = l.system.Load
+			if r.MetricType == CPUUsage {
+				value = l.system.CPU
+			}
+		case AvgRT:
+			if n := l.completed.sum(now); n > 0 {
+				value = l.rt.sum(now) / n
+			}
+		case SystemConcurrency:
+			value = float64(l.concurrency + 1)
+		case InboundQPS:
+			value = l.inbound.sum(now) + 1
+		}
+		if value > r.TriggerCount {
+			return pb.Local_LOCAL_BLOCKED
+		}
+	}
+	return pb.Local_LOCAL_ALLOWED
+}
+
+// checkResource evaluates the isolation rules and Reject flow rules for a resource. l.mu must be held.
+func (l *Limiter) checkResource(now time.Time, name string, res *resource) pb.Local {
+	for _, r := range l.isolation[name] {
+		if uint32(res.concurrency) >= r.Threshold {
+			return pb.Local_LOCAL_BLOCKED
+		}
+	}
+	for _, r := range l.flow[name] {
+		if r.ControlBehavior != Reject {
+			continue
+		}
+		passed := l.resources[r.statResource()].passed[r.interval()].sum(now)
+		if passed+1 > r.Threshold {
+			return pb.Local_LOCAL_BLOCKED
+		}
+	}
+	return pb.Local_LOCAL_ALLOWED
+}
+
+// reservation is a request's turn under a Throttling flow rule.
+type reservation struct {
+	rule       *flowRule
+	at, before time.Time // the turn, and the rule's lastPassed before it was reserved
+}
+
+// throttle reserves the request's turn under the Throttling flow rules for a resource, which pass requests
+// evenly spaced Threshold times per interval, returning how long it must wait. l.mu must be held.
+func (l *Limiter) throttle(now time.Time, name string) (time.Duration, []reservation, pb.Local) {
+	var wait time.Duration
+	var reserved []*flowRule
+	for _, r := range l.flow[name] {
+		if r.ControlBehavior != Throttling {
+			continue
+		}
+		if r.Threshold <= 0 {
+			return 0, nil, pb.Local_LOCAL_BLOCKED
+		}
+		gap := time.Duration(float64(r.interval()) / r.Threshold)
+		next := r.lastPassed.Add(gap)
+		if !next.After(now) {
+			next = now
+		}
+		if d := next.Sub(now); d > time.Duration(r.MaxQueueingTimeMs)*time.Millisecond {
+			return 0, nil, pb.Local_LOCAL_BLOCKED
+		} else if d > wait {
+			wait = d
+		}
+		reserved = append(reserved, r)
+	}
+	turn := make([]reservation, 0, len(reserved))
+	for _, r := range reserved {
+		turn = append(turn, reservation{rule: r, at: now.Add(wait), before: r.lastPassed})
+		r.lastPassed = now.Add(wait)
+	}
+	return wait, turn, pb.Local_LOCAL_ALLOWED
+}
+
+// cancel uncounts a request which passed at now but stopped waiting for its turns, and gives them back so the next
+// request can have them. A turn which a later request has already queued behind is kept, as that request's wait
+// is already set.
+func (l *Limiter) cancel(now time.Time, res *resource, turn []reservation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pass(now, res, -1)
+	for _, t := range turn {
+		if t.rule.lastPassed.Equal(t.at) {
+			t.rule.lastPassed = t.before
+		}
+	}
+}
+
+// Evaluator returns a guard.LocalEvaluator which enforces the rules for the named resource, usually the Guard's name.
+func (l *Limiter) Evaluator(resource string) guard.LocalEvaluator {
+	return evaluator{l: l, resource: resource}
+}
+
+type evaluator struct {
+	l        *Limiter
+	resource string
+}
+
+func (e evaluator) Evaluate(ctx context.Context, _ *guard.Request) (pb.Local, func(error)) {
+	local, entry := e.l.Entry(ctx, e.resource)
+	if entry == nil {
+		return local, nil
+	}
+	return local, entry.Exit
+}
@@ -0,0 +1,288 @@
+package sentinel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestWindow(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	tests := []struct {
+		name   string
+		adds   []int // times in ms to add 1 at
+		sumAt  int
+		expect float64
+	}{
+		{"empty", nil, 0, 0},
+		{"one bucket", []int{0, 10, 99}, 99, 3},
+		{"across buckets", []int{0, 150, 950}, 999, 3},
+		{"oldest bucket rolls off", []int{0, 150, 950}, 1000, 2},
+		{"whole window rolls off", []int{0, 150, 950}, 2000, 0},
+		{"bucket reused after a lap", []int{0, 1000}, 1000, 1},
+		{"late add to a reused bucket", []int{1000, 0}, 1000, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newWindow(time.Second)
+			for _, ms := range tt.adds {
+				w.add(at(ms), 1)
+			}
+			if got := w.sum(at(tt.sumAt)); got != tt.expect {
+				t.Errorf("got %v, want %v", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestEntry(t *testing.T) {
+	type call struct {
+		resource string
+		exit     bool // exit the entry straight away rather than keeping it in flight
+		expect   pb.Local
+	}
+	load := func(l float64) func() (SystemStats, error) {
+		return func() (SystemStats, error) { return SystemStats{Load: l}, nil }
+	}
+	tests := []struct {
+		name  string
+		cfg   *pb.SentinelConfig
+		stats func() (SystemStats, error)
+		calls []call
+	}{
+		{
+			name:  "no rules",
+			cfg:   &pb.SentinelConfig{},
+			calls: []call{{"api", true, pb.Local_LOCAL_EVAL_DISABLED}},
+		},
+		{
+			name: "flow limit",
+			cfg:  &pb.SentinelConfig{FlowRulesJson: proto.String(`[{"resource":"api","threshold":2}]`)},
+			calls: []call{
+				{"api", true, pb.Local_LOCAL_ALLOWED},
+				{"api", true, pb.Local_LOCAL_ALLOWED},
+				{"api", true, pb.Local_LOCAL_BLOCKED},
+				{"other", true, pb.Local_LOCAL_EVAL_DISABLED},
+			},
+		},
+		{
+			name: "flow limit on an associated resource",
+			cfg:  &pb.SentinelConfig{FlowRulesJson: proto.String(`[{"resource":"api","threshold":1,"relationStrategy":1,"refResource":"db"}]`)},
+			calls: []call{
+				{"api", true, pb.Local_LOCAL_ALLOWED},
+				{"db", true, pb.Local_LOCAL_EVAL_DISABLED},
+				{"api", true, pb.Local_LOCAL_BLOCKED},
+			},
+		},
+		{
+			name: "isolation",
+			cfg:  &pb.SentinelConfig{IsolationRulesJson: proto.String(`[{"resource":"api","threshold":1}]`)},
+			calls: []call{
+				{"api", true, pb.Local_LOCAL_ALLOWED},
+				{"api", false, pb.Local_LOCAL_ALLOWED},
+				{"api", true, pb.Local_LOCAL_BLOCKED},
+			},
+		},
+		{
+			name: "system concurrency",
+			cfg:  &pb.SentinelConfig{SystemRulesJson: proto.String(`[{"metricType":2,"triggerCount":1}]`)},
+			calls: []call{
+				{"api", false, pb.Local_LOCAL_ALLOWED},
+				{"other", true, pb.Local_LOCAL_BLOCKED},
+			},
+		},
+		{
+			name: "system inbound QPS",
+			cfg:  &pb.SentinelConfig{SystemRulesJson: proto.String(`[{"metricType":3,"triggerCount":1}]`)},
+			calls: []call{
+				{"api", true, pb.Local_LOCAL_ALLOWED},
+				{"other", true, pb.Local_LOCAL_BLOCKED},
+			},
+		},
+		{
+			name:  "system load under the trigger",
+			cfg:   &pb.SentinelConfig{SystemRulesJson: proto.String(`[{"metricType":0,"triggerCount":4}]`)},
+			stats: load(2),
+			calls: []call{{"api", true, pb.Local_LOCAL_ALLOWED}},
+		},
+		{
+			name:  "system load over the trigger",
+			cfg:   &pb.SentinelConfig{SystemRulesJson: proto.String(`[{"metricType":0,"triggerCount":4}]`)},
+			stats: load(8),
+			calls: []call{{"api", true, pb.Local_LOCAL_BLOCKED}},
+		},
+		{
+			name:  "system load unreadable",
+			cfg:   &pb.SentinelConfig{SystemRulesJson: proto.String(`[{"metricType":0,"triggerCount":4}]`)},
+			stats: func() (SystemStats, error) { return SystemStats{}, errors.New("no /proc") },
+			calls: []call{{"api", true, pb.Local_LOCAL_ERROR}},
+		},
+		{
+			name:  "throttling with no threshold",
+			cfg:   &pb.SentinelConfig{FlowRulesJson: proto.String(`[{"resource":"api","threshold":0,"controlBehavior":1}]`)},
+			calls: []call{{"api", true, pb.Local_LOCAL_BLOCKED}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := tt.stats
+			if stats == nil {
+				stats = load(0)
+			}
+			l := New(WithSystemStats(stats, time.Hour))
+			l.Update(tt.cfg)
+			for i, c := range tt.calls {
+				local, e := l.Entry(context.Background(), c.resource)
+				if local != c.expect {
+					t.Errorf("call %d to %s: got %v, want %v", i, c.resource, local, c.expect)
+				}
+				if e != nil && c.exit {
+					e.Exit(nil)
+				}
+			}
+		})
+	}
+}
+
+// fakeClock stands still until it is moved on, and records the waits of requests for their turns instead of
+// waiting, failing those whose context is done.
+type fakeClock struct {
+	mu    sync.Mutex
+	t     time.Time
+	waits []time.Duration
+}
+
+func newFakeClock(l *Limiter) *fakeClock {
+	c := &fakeClock{t: time.Unix(1000, 0)}
+	l.now, l.wait = c.now, c.wait
+	return c
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) wait(ctx context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	return ctx.Err()
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// waited returns how long the requests since the nth waited for their turns.
+func (c *fakeClock) waited(n int) []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waits[n:]
+}
+
+func TestThrottle(t *testing.T) {
+	// Two requests a second, so turns are 500ms apart, and requests wait for at most 600ms.
+	cfg := &pb.SentinelConfig{FlowRulesJson: proto.String(`[{"resource":"api","threshold":2,"controlBehavior":1,"maxQueueingTimeMs":600}]`)}
+	l := New(WithSystemStats(func() (SystemStats, error) { return SystemStats{}, nil }, time.Hour))
+	clock := newFakeClock(l)
+	if err := l.Update(cfg); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	steps := []struct {
+		name    string
+		ctx     context.Context
+		advance time.Duration // before the request
+		expect  pb.Local
+		wait    time.Duration
+	}{
+		{"first request", context.Background(), 0, pb.Local_LOCAL_ALLOWED, 0},
+		{"cancelled while waiting", cancelled, 0, pb.Local_LOCAL_BLOCKED, 500 * time.Millisecond},
+		// The cancelled request gave its turn back, so this one doesn't have to wait 1s, over the queueing limit.
+		{"after a cancelled request", context.Background(), 0, pb.Local_LOCAL_ALLOWED, 500 * time.Millisecond},
+		{"turn over the queueing limit", context.Background(), 0, pb.Local_LOCAL_BLOCKED, 0},
+		{"turn within the queueing limit", context.Background(), 500 * time.Millisecond, pb.Local_LOCAL_ALLOWED, 500 * time.Millisecond},
+		{"turn long past", context.Background(), 2 * time.Second, pb.Local_LOCAL_ALLOWED, 0},
+		{"next turn", context.Background(), 0, pb.Local_LOCAL_ALLOWED, 500 * time.Millisecond},
+	}
+	for i, step := range steps {
+		clock.advance(step.advance)
+		if i == len(steps)-1 {
+			// An unchanged rule keeps its turns across an update.
+			if err := l.Update(cfg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n := len(clock.waited(0))
+		if local, _ := l.Entry(step.ctx, "api"); local != step.expect {
+			t.Fatalf("%s: got %v, want %v", step.name, local, step.expect)
+		}
+		var waited time.Duration
+		if w := clock.waited(n); len(w) > 0 {
+			waited = w[0]
+		}
+		if waited != step.wait {
+			t.Fatalf("%s: waited %v, want %v", step.name, waited, step.wait)
+		}
+	}
+}
+
+func TestEntryConcurrent(t *testing.T) {
+	const threshold = 5
+	l := New(WithSystemStats(func() (SystemStats, error) { return SystemStats{}, nil }, time.Hour))
+	newFakeClock(l)
+	if err := l.Update(&pb.SentinelConfig{FlowRulesJson: proto.String(`[{"resource":"api","threshold":5}]`)}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var admitted atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if local, e := l.Entry(context.Background(), "api"); local == pb.Local_LOCAL_ALLOWED {
+				admitted.Add(1)
+				e.Exit(nil)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := admitted.Load(); got != threshold {
+		t.Errorf("admitted %d requests, want %d", got, threshold)
+	}
+}
+
+func TestUpdateBadRules(t *testing.T) {
+	l := New(WithSystemStats(func() (SystemStats, error) { return SystemStats{}, nil }, time.Hour))
+	newFakeClock(l)
+	if err := l.Update(&pb.SentinelConfig{FlowRulesJson: proto.String(`[{"resource":"api","threshold":1}]`)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Update(&pb.SentinelConfig{FlowRulesJson: proto.String(`[{"threshold":1}]`)}); err == nil {
+		t.Fatal("rule with no resource was accepted")
+	}
+	// The first rule is still enforced.
+	for i, expect := range []pb.Local{pb.Local_LOCAL_ALLOWED, pb.Local_LOCAL_BLOCKED} {
+		local, e := l.Entry(context.Background(), "api")
+		if local != expect {
+			t.Errorf("call %d: got %v, want %v", i, local, expect)
+		}
+		if e != nil {
+			e.Exit(nil)
+		}
+	}
+}
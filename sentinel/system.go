@@ -0,0 +1,61 @@
+package sentinel
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SystemStats are the host metrics which system rules are evaluated against.
+type SystemStats struct {
+	Load float64 // one minute load average
+	CPU  float64 // CPU usage since the previous sample, from 0 to 1
+}
+
+// ProcStats returns a function which reads SystemStats from /proc, so it only works on Linux.
+// CPU usage is measured between successive calls, or since boot on the first one.
+func ProcStats() func() (SystemStats, error) {
+	var lastTotal, lastIdle uint64
+	return func() (SystemStats, error) {
+		var stats SystemStats
+		loadavg, err := os.ReadFile("/proc/loadavg")
+		if err != nil {
+			return stats, err
+		}
+		fields := strings.Fields(string(loadavg))
+		if len(fields) == 0 {
+			return stats, fmt.Errorf("empty /proc/loadavg")
+		}
+		if stats.Load, err = strconv.ParseFloat(fields[0], 64); err != nil {
+			return stats, fmt.Errorf("parsing /proc/loadavg: %w", err)
+		}
+
+		stat, err := os.ReadFile("/proc/stat")
+		if err != nil {
+			return stats, err
+		}
+		line, _, _ := strings.Cut(string(stat), "\n")
+		fields = strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "cpu" {
+			return stats, fmt.Errorf("unexpected /proc/stat line %q", line)
+		}
+		// user nice system idle iowait irq softirq steal; guest time is already counted in user.
+		var total, idle uint64
+		for i, f := range fields[1:min(len(fields), 9)] {
+			n, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return stats, fmt.Errorf("parsing /proc/stat: %w", err)
+			}
+			total += n
+			if i == 3 || i == 4 {
+				idle += n
+			}
+		}
+		if total > lastTotal {
+			stats.CPU = 1 - float64(idle-lastIdle)/float64(total-lastTotal)
+		}
+		lastTotal, lastIdle = total, idle
+		return stats, nil
+	}
+}
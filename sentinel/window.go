@@ -0,0 +1,47 @@
+package sentinel
+
+import "time"
+
+// windowBuckets is how many buckets each sliding window is divided into.
+const windowBuckets = 10
+
+// window sums values over a sliding interval, in buckets which are reset as the window moves past them.
+// It is not safe for concurrent use.
+type window struct {
+	size    int64 // nanoseconds per bucket
+	buckets [windowBuckets]bucket
+}
+
+type bucket struct {
+	start int64
+	value float64
+}
+
+func newWindow(interval time.Duration) *window {
+	return &window{size: max(int64(interval)/windowBuckets, 1)}
+}
+
+// add adds v at now. Values added at times whose bucket has since been reused are dropped, as they have already
+// rolled out of the window.
+func (w *window) add(now time.Time, v float64) {
+	start := now.UnixNano() / w.size * w.size
+	b := &w.buckets[start/w.size%windowBuckets]
+	if start < b.start {
+		return
+	}
+	if b.start != start {
+		b.start, b.value = start, 0
+	}
+	b.value += v
+}
+
+func (w *window) sum(now time.Time) float64 {
+	oldest := now.UnixNano() - w.size*windowBuckets
+	total := 0.0
+	for _, b := range w.buckets {
+		if b.start > oldest {
+			total += b.value
+		}
+	}
+	return total
+}
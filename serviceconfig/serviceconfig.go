@@ -0,0 +1,170 @@
+// Package serviceconfig keeps a service's ServiceConfig up to date by polling GetServiceConfig, and tells
+// the parts of the service which depend on it, such as Sentinel rules and circuit breakers, when it changes.
+package serviceconfig
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// Defaults for the Watcher options.
+const (
+	DefaultInterval = 15 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+// Watcher polls the hub for new versions of a service's config. It is safe for concurrent use.
+type Watcher struct {
+	client   pb.ConfigServiceClient
+	apikey   string
+	service  *pb.ServiceSelector
+	clientID string
+	interval time.Duration
+	timeout  time.Duration
+	onChange []func(version string, cfg *pb.ServiceConfig)
+
+	refreshing sync.Mutex // held for the whole of Refresh, so responses and changes are applied in order
+
+	mu      sync.Mutex
+	version string
+	config  *pb.ServiceConfig
+	err     error
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Option configures a Watcher.
+type Option func(*Watcher)
+
+// WithRelease sets the service release, if the config differs between releases.
+func WithRelease(release string) Option {
+	return func(w *Watcher) {
+		w.service.Release = proto.String(release)
+	}
+}
+
+// WithTags sets the service's tags.
+func WithTags(tags []*pb.Tag) Option {
+	return func(w *Watcher) {
+		w.service.Tags = tags
+	}
+}
+
+// WithClientID sets the client ID sent with each request, which should be the same one used for quota requests.
+func WithClientID(id string) Option {
+	return func(w *Watcher) {
+		w.clientID = id
+	}
+}
+
+// WithInterval polls for a new config this often.
+func WithInterval(d time.Duration) Option {
+	return func(w *Watcher) {
+		w.interval = d
+	}
+}
+
+// WithChange calls f with every new version of the config, in the order the options were given.
+// f is called from the Watcher's goroutine, or from Refresh.
+func WithChange(f func(version string, cfg *pb.ServiceConfig)) Option {
+	return func(w *Watcher) {
+		w.onChange = append(w.onChange, f)
+	}
+}
+
+// NewWatcher returns a Watcher for the named service in environment, which authenticates to the hub on conn with apikey.
+// It polls in the background until Close is called; call Refresh to load the first config straight away.
+func NewWatcher(conn grpc.ClientConnInterface, apikey, environment, service string, opts ...Option) *Watcher {
+	w := &Watcher{
+		client:   pb.NewConfigServiceClient(conn),
+		apikey:   apikey,
+		service:  &pb.ServiceSelector{Environment: environment, Name: service},
+		interval: DefaultInterval,
+		timeout:  DefaultTimeout,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	go w.loop()
+	return w
+}
+
+// Config returns the current config and its version, or nil if none has been loaded.
+func (w *Watcher) Config() (string, *pb.ServiceConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.version, w.config
+}
+
+// Err returns the error from the last poll, if it failed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close stops polling.
+func (w *Watcher) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *Watcher) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+			w.Refresh(ctx)
+			cancel()
+		}
+	}
+}
+
+// Refresh asks the hub for a newer config now, calling the change functions if there is one. Concurrent calls
+// are made one at a time, so an older response can't replace a newer config.
+func (w *Watcher) Refresh(ctx context.Context) error {
+	w.refreshing.Lock()
+	defer w.refreshing.Unlock()
+	w.mu.Lock()
+	req := &pb.GetServiceConfigRequest{VersionSeen: w.version, Service: w.service}
+	if w.clientID != "" {
+		req.ClientId = proto.String(w.clientID)
+	}
+	w.mu.Unlock()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", w.apikey)
+	res, err := w.client.GetServiceConfig(ctx, req)
+	if err != nil {
+		err = fmt.Errorf("loading config for service %q: %w", w.service.GetName(), err)
+	}
+
+	w.mu.Lock()
+	w.err = err
+	changed := err == nil && res.GetConfigDataSent() && res.GetConfig() != nil && res.GetVersion() != w.version
+	if changed {
+		w.version, w.config = res.GetVersion(), res.GetConfig()
+	}
+	w.mu.Unlock()
+
+	if changed {
+		for _, f := range w.onChange {
+			f(res.GetVersion(), res.GetConfig())
+		}
+	}
+	return err
+}
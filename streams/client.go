@@ -0,0 +1,75 @@
+// Package streams is a client for the Stanza Stream Balancer API.
+package streams
+
+import (
+	"context"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Client issues UpdateStreams calls for a single Guard and environment.
+type Client struct {
+	client      pb.StreamBalancerServiceClient
+	apikey      string
+	guard       string
+	environment string
+	recorder    *Recorder
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithRecorder records every UpdateStreams call made by the Client to r.
+func WithRecorder(r *Recorder) Option {
+	return func(c *Client) {
+		c.recorder = r
+	}
+}
+
+// NewClient returns a Client which authenticates to the hub on conn with apikey.
+func NewClient(conn grpc.ClientConnInterface, apikey, guard, environment string, opts ...Option) *Client {
+	c := &Client{
+		client:      pb.NewStreamBalancerServiceClient(conn),
+		apikey:      apikey,
+		guard:       guard,
+		environment: environment,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Update requests allocations for new streams and marks ended streams as completed.
+func (c *Client) Update(ctx context.Context, reqs []*pb.StreamRequest, ended []string) (*pb.UpdateStreamsResponse, error) {
+	return c.Send(ctx, c.Request(reqs, ended))
+}
+
+// Request builds the UpdateStreamsRequest which Update would send for the Client's Guard.
+func (c *Client) Request(reqs []*pb.StreamRequest, ended []string) *pb.UpdateStreamsRequest {
+	return &pb.UpdateStreamsRequest{
+		GuardName:   c.guard,
+		Environment: c.environment,
+		Requests:    reqs,
+		Ended:       ended,
+	}
+}
+
+// Send issues req as is, which may name a different Guard to the Client's.
+func (c *Client) Send(ctx context.Context, req *pb.UpdateStreamsRequest) (*pb.UpdateStreamsResponse, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", c.apikey)
+	sent := time.Now()
+	res, err := c.client.UpdateStreams(ctx, req)
+	if c.recorder != nil {
+		rec := &Record{Time: sent, Request: req, Response: res}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+		c.recorder.Write(rec)
+	}
+	return res, err
+}
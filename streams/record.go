@@ -0,0 +1,256 @@
+package streams
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Record formats.
+const (
+	// FormatNDJSON writes one JSON object per line, with the request and response in protojson form.
+	FormatNDJSON = "ndjson"
+	// FormatDelimited writes varint length-delimited protobuf messages with the layout
+	//
+	//	message Record {
+	//	  google.protobuf.Timestamp time = 1;
+	//	  stanza.hub.v1.UpdateStreamsRequest request = 2;
+	//	  stanza.hub.v1.UpdateStreamsResponse response = 3;
+	//	  string error = 4;
+	//	}
+	FormatDelimited = "delimited"
+)
+
+// Record is a single recorded UpdateStreams call.
+type Record struct {
+	Time     time.Time // when the request was sent
+	Request  *pb.UpdateStreamsRequest
+	Response *pb.UpdateStreamsResponse // nil if the call failed
+	Error    string
+}
+
+// Recorder writes Records to a stream. It is safe for concurrent use.
+// Each Record is written with a single Write call, so nothing is lost if the program exits abruptly.
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	err    error
+}
+
+// NewRecorder returns a Recorder which writes to w in the given format.
+func NewRecorder(w io.Writer, format string) (*Recorder, error) {
+	if format != FormatNDJSON && format != FormatDelimited {
+		return nil, fmt.Errorf("unknown record format %q, must be %s or %s", format, FormatNDJSON, FormatDelimited)
+	}
+	return &Recorder{w: w, format: format}, nil
+}
+
+// Write appends rec. Errors are sticky and reported by Err.
+func (r *Recorder) Write(rec *Record) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+
+	var data []byte
+	if r.format == FormatNDJSON {
+		data, r.err = marshalJSON(rec)
+		data = append(data, '\n')
+	} else {
+		data, r.err = marshalDelimited(rec)
+	}
+	if r.err == nil {
+		_, r.err = r.w.Write(data)
+	}
+}
+
+// Err returns the first error encountered while writing Records.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+type recordJSON struct {
+	Time     time.Time       `json:"time"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func marshalJSON(rec *Record) ([]byte, error) {
+	rj := recordJSON{Time: rec.Time, Error: rec.Error}
+	var err error
+	if rj.Request, err = protojson.Marshal(rec.Request); err != nil {
+		return nil, err
+	}
+	if rec.Response != nil {
+		if rj.Response, err = protojson.Marshal(rec.Response); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(rj)
+}
+
+func marshalDelimited(rec *Record) ([]byte, error) {
+	var msg []byte
+	for _, f := range []struct {
+		num protowire.Number
+		m   proto.Message
+	}{
+		{1, timestamppb.New(rec.Time)},
+		{2, rec.Request},
+		{3, rec.Response},
+	} {
+		if f.m == nil || !f.m.ProtoReflect().IsValid() {
+			continue
+		}
+		b, err := proto.Marshal(f.m)
+		if err != nil {
+			return nil, err
+		}
+		msg = protowire.AppendTag(msg, f.num, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, b)
+	}
+	if rec.Error != "" {
+		msg = protowire.AppendTag(msg, 4, protowire.BytesType)
+		msg = protowire.AppendString(msg, rec.Error)
+	}
+	return protowire.AppendBytes(nil, msg), nil
+}
+
+// Reader reads Records written by a Recorder.
+type Reader struct {
+	r      *bufio.Reader
+	format string
+}
+
+// NewReader returns a Reader for records in the given format.
+func NewReader(r io.Reader, format string) (*Reader, error) {
+	if format != FormatNDJSON && format != FormatDelimited {
+		return nil, fmt.Errorf("unknown record format %q, must be %s or %s", format, FormatNDJSON, FormatDelimited)
+	}
+	return &Reader{r: bufio.NewReader(r), format: format}, nil
+}
+
+// Next returns the next Record, or io.EOF when there are no more.
+func (r *Reader) Next() (*Record, error) {
+	if r.format == FormatNDJSON {
+		return r.nextJSON()
+	}
+	return r.nextDelimited()
+}
+
+// ReadAll returns every remaining Record.
+func (r *Reader) ReadAll() ([]*Record, error) {
+	var recs []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func (r *Reader) nextJSON() (*Record, error) {
+	var line []byte
+	for len(line) == 0 {
+		var err error
+		line, err = r.r.ReadBytes('\n')
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 1 {
+			line = nil // skip blank lines
+		}
+	}
+
+	var rj recordJSON
+	if err := json.Unmarshal(line, &rj); err != nil {
+		return nil, err
+	}
+	rec := &Record{Time: rj.Time, Request: &pb.UpdateStreamsRequest{}, Error: rj.Error}
+	if err := protojson.Unmarshal(rj.Request, rec.Request); err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	if len(rj.Response) > 0 {
+		rec.Response = &pb.UpdateStreamsResponse{}
+		if err := protojson.Unmarshal(rj.Response, rec.Response); err != nil {
+			return nil, fmt.Errorf("response: %w", err)
+		}
+	}
+	return rec, nil
+}
+
+func (r *Reader) nextDelimited() (*Record, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r.r, msg); err != nil {
+		return nil, err
+	}
+
+	rec := &Record{Request: &pb.UpdateStreamsRequest{}}
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+		if typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, msg)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			msg = msg[n:]
+			continue
+		}
+		b, n := protowire.ConsumeBytes(msg)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		switch num {
+		case 1:
+			ts := &timestamppb.Timestamp{}
+			if err := proto.Unmarshal(b, ts); err != nil {
+				return nil, fmt.Errorf("time: %w", err)
+			}
+			rec.Time = ts.AsTime()
+		case 2:
+			err = proto.Unmarshal(b, rec.Request)
+		case 3:
+			rec.Response = &pb.UpdateStreamsResponse{}
+			err = proto.Unmarshal(b, rec.Response)
+		case 4:
+			rec.Error = string(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rec, nil
+}
@@ -0,0 +1,247 @@
+// Package tokens validates ingress tokens: quota tokens issued to an upstream service, which
+// a downstream service checks before serving its request when GuardConfig.ValidateIngressTokens is set.
+package tokens
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults for the Validator options.
+const (
+	DefaultBatchSize = 50
+	DefaultMaxWait   = 5 * time.Millisecond
+	DefaultCacheTTL  = 10 * time.Second
+	DefaultTimeout   = time.Second
+)
+
+// Validator checks tokens with the hub's ValidateToken API. Tokens from concurrent callers are collected
+// for up to a short wait and sent in one call, and valid tokens are cached until they expire.
+// It is safe for concurrent use.
+type Validator struct {
+	client    pb.QuotaServiceClient
+	apikey    string
+	batchSize int
+	maxWait   time.Duration
+	cacheTTL  time.Duration
+	timeout   time.Duration
+
+	mu      sync.Mutex
+	valid   map[string]time.Time // cache key to expiry
+	pending []*waiter
+	timer   *time.Timer
+}
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithBatchSize sends a batch as soon as it holds n tokens.
+func WithBatchSize(n int) Option {
+	return func(v *Validator) {
+		v.batchSize = n
+	}
+}
+
+// WithMaxWait waits at most d for more tokens to arrive before sending a batch.
+func WithMaxWait(d time.Duration) Option {
+	return func(v *Validator) {
+		v.maxWait = d
+	}
+}
+
+// WithCacheTTL caches valid tokens for d if their expiry can't be read from the token itself.
+func WithCacheTTL(d time.Duration) Option {
+	return func(v *Validator) {
+		v.cacheTTL = d
+	}
+}
+
+// WithTimeout bounds each ValidateToken call.
+func WithTimeout(d time.Duration) Option {
+	return func(v *Validator) {
+		v.timeout = d
+	}
+}
+
+// NewValidator returns a Validator which authenticates to the hub on conn with apikey.
+func NewValidator(conn grpc.ClientConnInterface, apikey string, opts ...Option) *Validator {
+	v := &Validator{
+		client:    pb.NewQuotaServiceClient(conn),
+		apikey:    apikey,
+		batchSize: DefaultBatchSize,
+		maxWait:   DefaultMaxWait,
+		cacheTTL:  DefaultCacheTTL,
+		timeout:   DefaultTimeout,
+		valid:     make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+type waiter struct {
+	key    string
+	info   *pb.TokenInfo
+	result chan pb.Token
+}
+
+// Validate checks that token was issued for guard, returning TOKEN_VALID, TOKEN_NOT_VALID,
+// TOKEN_VALIDATION_ERROR or TOKEN_VALIDATION_TIMEOUT.
+func (v *Validator) Validate(ctx context.Context, token string, guard *pb.GuardSelector) pb.Token {
+	if token == "" {
+		return pb.Token_TOKEN_NOT_VALID
+	}
+	w := &waiter{key: cacheKey(token, guard), info: &pb.TokenInfo{Token: token, Guard: guard}, result: make(chan pb.Token, 1)}
+
+	v.mu.Lock()
+	if expires, ok := v.valid[w.key]; ok {
+		if time.Now().Before(expires) {
+			v.mu.Unlock()
+			return pb.Token_TOKEN_VALID
+		}
+		delete(v.valid, w.key)
+	}
+	v.pending = append(v.pending, w)
+	if len(v.pending) >= v.batchSize {
+		v.sendLocked()
+	} else if v.timer == nil {
+		v.timer = time.AfterFunc(v.maxWait, func() {
+			v.mu.Lock()
+			defer v.mu.Unlock()
+			v.sendLocked()
+		})
+	}
+	v.mu.Unlock()
+
+	select {
+	case t := <-w.result:
+		return t
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return pb.Token_TOKEN_VALIDATION_TIMEOUT
+		}
+		return pb.Token_TOKEN_VALIDATION_ERROR
+	}
+}
+
+// sendLocked sends the pending batch in the background. v.mu must be held.
+func (v *Validator) sendLocked() {
+	if v.timer != nil {
+		v.timer.Stop()
+		v.timer = nil
+	}
+	if len(v.pending) == 0 {
+		return
+	}
+	batch := v.pending
+	v.pending = nil
+	go v.send(batch)
+}
+
+func (v *Validator) send(batch []*waiter) {
+	req := &pb.ValidateTokenRequest{}
+	for _, w := range batch {
+		req.Tokens = append(req.Tokens, w.info)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "X-Stanza-Key", v.apikey)
+	res, err := v.client.ValidateToken(ctx, req)
+
+	if err != nil {
+		result := pb.Token_TOKEN_VALIDATION_ERROR
+		if status.Code(err) == codes.DeadlineExceeded {
+			result = pb.Token_TOKEN_VALIDATION_TIMEOUT
+		}
+		for _, w := range batch {
+			w.result <- result
+		}
+		return
+	}
+
+	// Results are matched up by token. A token can be in a batch more than once, such as for different Guards,
+	// and then its results are matched up in order, unless the hub returned just one for all of them.
+	byToken := make(map[string][]bool)
+	for _, r := range res.GetTokensValid() {
+		byToken[r.GetToken()] = append(byToken[r.GetToken()], r.GetValid())
+	}
+	count := make(map[string]int, len(batch))
+	for _, w := range batch {
+		count[w.info.Token]++
+	}
+	now := time.Now()
+	v.mu.Lock()
+	for key, expires := range v.valid {
+		if !now.Before(expires) {
+			delete(v.valid, key)
+		}
+	}
+	seen := make(map[string]int, len(batch))
+	for _, w := range batch {
+		valid, ok := match(byToken[w.info.Token], count[w.info.Token], seen[w.info.Token])
+		seen[w.info.Token]++
+		switch {
+		case !ok:
+			w.result <- pb.Token_TOKEN_VALIDATION_ERROR
+		case !valid:
+			w.result <- pb.Token_TOKEN_NOT_VALID
+		default:
+			v.valid[w.key] = v.expiry(w.info.Token, now)
+			w.result <- pb.Token_TOKEN_VALID
+		}
+	}
+	v.mu.Unlock()
+}
+
+// match returns the result for the i'th of n copies of a token in a batch, given the hub's results for the token.
+func match(results []bool, n, i int) (valid, ok bool) {
+	switch len(results) {
+	case 0:
+		return false, false
+	case 1:
+		return results[0], true
+	case n:
+		return results[i], true
+	}
+	return false, false
+}
+
+// expiry returns when a valid token should be dropped from the cache: its exp claim if it is a JWT,
+// and otherwise the cache TTL from now.
+func (v *Validator) expiry(token string, now time.Time) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(parts[1]); err == nil {
+			var claims struct {
+				Exp int64 `json:"exp"`
+			}
+			if json.Unmarshal(payload, &claims) == nil && claims.Exp > 0 {
+				return time.Unix(claims.Exp, 0)
+			}
+		}
+	}
+	return now.Add(v.cacheTTL)
+}
+
+func cacheKey(token string, guard *pb.GuardSelector) string {
+	tags := make([]string, 0, len(guard.GetTags()))
+	for _, t := range guard.GetTags() {
+		tags = append(tags, t.GetKey()+"="+t.GetValue())
+	}
+	sort.Strings(tags)
+	return strings.Join([]string{token, guard.GetEnvironment(), guard.GetName(), strings.Join(tags, ",")}, "\x00")
+}
@@ -0,0 +1,158 @@
+package tokens
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeHub answers ValidateToken calls with validate.
+type fakeHub struct {
+	validate func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error)
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (h *fakeHub) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	h.mu.Lock()
+	h.calls++
+	h.mu.Unlock()
+	res, err := h.validate(args.(*pb.ValidateTokenRequest))
+	if err != nil {
+		return err
+	}
+	proto.Merge(reply.(proto.Message), res)
+	return nil
+}
+
+func (h *fakeHub) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	panic("not implemented")
+}
+
+// validFor answers each token in the request in turn, valid if it was sent for the Guard "ok".
+func validFor(req *pb.ValidateTokenRequest) []*pb.TokenValid {
+	var results []*pb.TokenValid
+	for _, info := range req.GetTokens() {
+		results = append(results, &pb.TokenValid{Token: info.GetToken(), Valid: info.GetGuard().GetName() == "ok"})
+	}
+	return results
+}
+
+func TestValidateBatch(t *testing.T) {
+	type check struct {
+		token, guard string
+		expect       pb.Token
+	}
+	tests := []struct {
+		name     string
+		checks   []check
+		validate func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error)
+	}{
+		{
+			name:   "results in a different order",
+			checks: []check{{"a", "ok", pb.Token_TOKEN_VALID}, {"b", "bad", pb.Token_TOKEN_NOT_VALID}, {"c", "ok", pb.Token_TOKEN_VALID}},
+			validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+				results := validFor(req)
+				sort.SliceStable(results, func(i, j int) bool { return results[i].Token > results[j].Token })
+				return &pb.ValidateTokenResponse{TokensValid: results}, nil
+			},
+		},
+		{
+			name:   "one token for different Guards",
+			checks: []check{{"a", "ok", pb.Token_TOKEN_VALID}, {"a", "bad", pb.Token_TOKEN_NOT_VALID}, {"b", "ok", pb.Token_TOKEN_VALID}},
+			validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+				results := validFor(req)
+				sort.SliceStable(results, func(i, j int) bool { return results[i].Token > results[j].Token })
+				return &pb.ValidateTokenResponse{TokensValid: results}, nil
+			},
+		},
+		{
+			name:   "one result for a repeated token",
+			checks: []check{{"a", "ok", pb.Token_TOKEN_VALID}, {"a", "other", pb.Token_TOKEN_VALID}, {"b", "bad", pb.Token_TOKEN_NOT_VALID}},
+			validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+				return &pb.ValidateTokenResponse{TokensValid: []*pb.TokenValid{{Token: "b"}, {Token: "a", Valid: true}}}, nil
+			},
+		},
+		{
+			name:   "missing result",
+			checks: []check{{"a", "ok", pb.Token_TOKEN_VALID}, {"b", "ok", pb.Token_TOKEN_VALIDATION_ERROR}},
+			validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+				return &pb.ValidateTokenResponse{TokensValid: []*pb.TokenValid{{Token: "a", Valid: true}}}, nil
+			},
+		},
+		{
+			name:   "hub error",
+			checks: []check{{"a", "ok", pb.Token_TOKEN_VALIDATION_ERROR}, {"b", "ok", pb.Token_TOKEN_VALIDATION_ERROR}},
+			validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+				return nil, status.Error(codes.Unavailable, "down")
+			},
+		},
+		{
+			name:   "hub timeout",
+			checks: []check{{"a", "ok", pb.Token_TOKEN_VALIDATION_TIMEOUT}},
+			validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+				return nil, status.Error(codes.DeadlineExceeded, "slow")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := &fakeHub{validate: tt.validate}
+			// The batch is only sent once it is full, so every check must go in the same call.
+			v := NewValidator(hub, "key", WithBatchSize(len(tt.checks)), WithMaxWait(time.Minute))
+			got := make([]pb.Token, len(tt.checks))
+			var wg sync.WaitGroup
+			for i, c := range tt.checks {
+				wg.Add(1)
+				go func(i int, c check) {
+					defer wg.Done()
+					got[i] = v.Validate(context.Background(), c.token, &pb.GuardSelector{Environment: "env", Name: c.guard})
+				}(i, c)
+			}
+			wg.Wait()
+			if hub.calls != 1 {
+				t.Errorf("got %d ValidateToken calls, want 1", hub.calls)
+			}
+			for i, c := range tt.checks {
+				if got[i] != c.expect {
+					t.Errorf("token %q for Guard %q: got %v, want %v", c.token, c.guard, got[i], c.expect)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateCache(t *testing.T) {
+	hub := &fakeHub{validate: func(req *pb.ValidateTokenRequest) (*pb.ValidateTokenResponse, error) {
+		return &pb.ValidateTokenResponse{TokensValid: validFor(req)}, nil
+	}}
+	v := NewValidator(hub, "key", WithMaxWait(time.Millisecond), WithCacheTTL(time.Hour))
+	ok, bad := &pb.GuardSelector{Name: "ok"}, &pb.GuardSelector{Name: "bad"}
+	for i, want := range []struct {
+		guard  *pb.GuardSelector
+		expect pb.Token
+		calls  int
+	}{
+		{ok, pb.Token_TOKEN_VALID, 1},
+		{ok, pb.Token_TOKEN_VALID, 1}, // cached
+		{bad, pb.Token_TOKEN_NOT_VALID, 2},
+		{bad, pb.Token_TOKEN_NOT_VALID, 3}, // invalid tokens are not cached
+	} {
+		if got := v.Validate(context.Background(), "a", want.guard); got != want.expect || hub.calls != want.calls {
+			t.Errorf("check %d: got %v after %d calls, want %v after %d", i, got, hub.calls, want.expect, want.calls)
+		}
+	}
+	if got := v.Validate(context.Background(), "", ok); got != pb.Token_TOKEN_NOT_VALID {
+		t.Errorf("empty token: got %v", got)
+	}
+}
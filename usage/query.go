@@ -0,0 +1,208 @@
+package usage
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultRange is how far back a query goes if it has no StartTs.
+const DefaultRange = time.Hour
+
+// maxPoints is the number of data points a query's default step keeps each timeseries under.
+const maxPoints = 100
+
+// steps are the default steps to choose from, shortest first.
+var steps = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, time.Hour,
+	3 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour, 7 * 24 * time.Hour}
+
+// group is the data points of one timeseries in a query's result.
+type group struct {
+	ts     *pb.UsageTimeseries
+	points []*counts
+}
+
+// Query answers a GetUsage request from the recorded events. Timeseries are split by every axis whose query mode
+// is QUERY_MODE_REPORT, and by the tags in ReportTags, or every tag if ReportAllTags is set; other axes are summed.
+// Each has a data point for every step from StartTs, which is rounded down to a whole minute, to EndTs. Invalid
+// requests fail with codes.InvalidArgument.
+func (r *Recorder) Query(req *pb.GetUsageRequest) (*pb.GetUsageResponse, error) {
+	if req.GetEnvironment() == "" {
+		return nil, status.Error(codes.InvalidArgument, "environment is required")
+	}
+	end := r.now()
+	if req.EndTs != nil {
+		end = req.GetEndTs().AsTime()
+	}
+	start := end.Add(-DefaultRange)
+	if req.StartTs != nil {
+		start = req.GetStartTs().AsTime()
+	}
+	from, to := minute(start), minute(end.Add(Resolution-time.Nanosecond))
+	if from >= to {
+		return nil, status.Error(codes.InvalidArgument, "start_ts must be before end_ts")
+	}
+	span := time.Duration(to-from) * Resolution
+	step := steps[len(steps)-1]
+	if req.Step != nil {
+		var err error
+		if step, err = parseStep(req.GetStep()); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, s := range steps {
+			if span/s < maxPoints {
+				step = s
+				break
+			}
+		}
+	}
+	width := int64(step / Resolution)
+	n := (to - from + width - 1) / width
+
+	var keyHash string
+	if req.Apikey != nil {
+		keyHash = hash(req.GetApikey())
+	}
+	report := func(m *pb.QueryMode) bool { return m != nil && *m == pb.QueryMode_QUERY_MODE_REPORT }
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	groups := make(map[string]*group)
+	for _, s := range r.series {
+		if !matches(req, keyHash, &s.dims) {
+			continue
+		}
+		ts := &pb.UsageTimeseries{}
+		var key []string
+		if report(req.GuardQueryMode) {
+			ts.Guard = proto.String(s.guard)
+			key = append(key, "guard="+strconv.Quote(s.guard))
+		}
+		if report(req.FeatureQueryMode) {
+			ts.Feature = proto.String(s.feature)
+			key = append(key, "feature="+strconv.Quote(s.feature))
+		}
+		if report(req.ServiceQueryMode) {
+			ts.Service = proto.String(s.service)
+			key = append(key, "service="+strconv.Quote(s.service))
+		}
+		if report(req.PriorityQueryMode) {
+			ts.Priority = proto.Int32(s.priority)
+			key = append(key, "priority="+strconv.Itoa(int(s.priority)))
+		}
+		tags := make(map[string]string)
+		for k, v := range s.tags {
+			if req.GetReportAllTags() || contains(req.GetReportTags(), k) {
+				tags[k] = v
+			}
+		}
+		for _, k := range sortedKeys(tags) {
+			ts.Tags = append(ts.Tags, &pb.Tag{Key: k, Value: tags[k]})
+		}
+		key = append(key, tagKey(tags)...)
+
+		for start, c := range s.buckets {
+			if start < from || start >= to {
+				continue
+			}
+			k := strings.Join(key, ",")
+			g := groups[k]
+			if g == nil {
+				g = &group{ts: ts, points: make([]*counts, n)}
+				for i := range g.points {
+					g.points[i] = &counts{}
+				}
+				groups[k] = g
+			}
+			g.points[(start-from)/width].add(c)
+		}
+	}
+
+	resp := &pb.GetUsageResponse{}
+	for _, k := range sortedKeys(groups) {
+		g := groups[k]
+		for i, c := range g.points {
+			pointStart := from + int64(i)*width
+			g.ts.Data = append(g.ts.Data, &pb.UsageTSDataPoint{
+				StartTs:            timestamppb.New(time.Unix(pointStart*int64(Resolution/time.Second), 0)),
+				EndTs:              timestamppb.New(time.Unix(min(pointStart+width, to)*int64(Resolution/time.Second), 0)),
+				Granted:            c.granted,
+				GrantedWeight:      c.grantedWeight,
+				NotGranted:         c.notGranted,
+				NotGrantedWeight:   c.notGrantedWeight,
+				BeBurst:            proto.Int32(c.burst),
+				BeBurstWeight:      proto.Float32(c.burstWeight),
+				ParentReject:       proto.Int32(c.parentReject),
+				ParentRejectWeight: proto.Float32(c.parentRejectWeight),
+			})
+		}
+		resp.Result = append(resp.Result, g.ts)
+	}
+	return resp, nil
+}
+
+// matches reports whether a series passes the request's filters. keyHash is the hash of its API key, if it has one.
+func matches(req *pb.GetUsageRequest, keyHash string, d *dims) bool {
+	switch {
+	case d.environment != req.GetEnvironment(),
+		req.Guard != nil && d.guard != req.GetGuard(),
+		req.Feature != nil && d.feature != req.GetFeature(),
+		req.Service != nil && d.service != req.GetService(),
+		req.Priority != nil && d.priority != req.GetPriority(),
+		req.Apikey != nil && d.keyHash != keyHash:
+		return false
+	}
+	if req.GetReportAllTags() {
+		return true
+	}
+	for _, t := range req.GetTags() {
+		if v, ok := d.tags[t.GetKey()]; !ok || v != t.GetValue() {
+			return false
+		}
+	}
+	return true
+}
+
+// parseStep parses a GetUsage step: a whole number of minutes (m), hours (h), days (d) or weeks (w), from 1m to 1w.
+func parseStep(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{'m': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if len(s) < 2 || units[s[len(s)-1]] == 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "step %q must be a number of minutes (m), hours (h), days (d) or weeks (w)", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 1 {
+		return 0, status.Errorf(codes.InvalidArgument, "step %q must be a number of minutes (m), hours (h), days (d) or weeks (w)", s)
+	}
+	d := time.Duration(n) * units[s[len(s)-1]]
+	if d > 7*24*time.Hour {
+		return 0, status.Errorf(codes.InvalidArgument, "step %q is longer than 1w", s)
+	}
+	return d, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,23 @@
+package usage
+
+import (
+	"context"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Server implements UsageService.
+type Server struct {
+	pb.UnimplementedUsageServiceServer
+	recorder *Recorder
+}
+
+// NewServer returns a UsageService which answers queries from r.
+func NewServer(r *Recorder) *Server {
+	return &Server{recorder: r}
+}
+
+// GetUsage queries the recorded events.
+func (s *Server) GetUsage(ctx context.Context, req *pb.GetUsageRequest) (*pb.GetUsageResponse, error) {
+	return s.recorder.Query(req)
+}
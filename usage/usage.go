@@ -0,0 +1,190 @@
+// Package usage records the quota decisions of a locally run hub and answers UsageService.GetUsage queries over
+// them, so that dashboards can be developed offline against the real UsageTimeseries shape.
+//
+// The hub calls Recorder.Record for every GetToken or GetTokenLease decision. Events are counted in one-minute
+// buckets, the smallest GetUsage step, for each combination of environment, Guard, feature, service, API key,
+// priority and tags, and buckets older than the retention period are dropped. NewServer serves GetUsage from a
+// Recorder.
+package usage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+)
+
+// Resolution is the width of the buckets events are counted in.
+const Resolution = time.Minute
+
+// DefaultRetention is how long events are kept if WithRetention is not given.
+const DefaultRetention = 7 * 24 * time.Hour
+
+// Event is one quota decision.
+type Event struct {
+	Time        time.Time // now if zero
+	Environment string
+	Guard       string
+	Feature     string
+	Service     string // the client's service, if it sent a client ID
+	APIKey      string
+	Priority    int32 // the feature's priority with any boost applied
+	Tags        []*pb.Tag
+	Granted     bool
+	Reason      pb.Reason // REASON_BURST and REASON_BEST_EFFORT grants count as burst, and REASON_INSUFFICIENT_QUOTA_PARENT denials as parent rejects
+	Weight      float32   // 1 if zero
+}
+
+// Recorder counts Events. It is safe for concurrent use.
+type Recorder struct {
+	retention time.Duration
+	now       func() time.Time
+
+	mu     sync.Mutex
+	series map[string]*series
+	pruned time.Time
+}
+
+// series holds the counts for one combination of dimensions.
+type series struct {
+	dims
+	buckets map[int64]*counts // by start, in Unix minutes
+}
+
+type dims struct {
+	environment, guard, feature, service, keyHash string
+	priority                                      int32
+	tags                                          map[string]string
+}
+
+type counts struct {
+	granted, notGranted, burst, parentReject                         int32
+	grantedWeight, notGrantedWeight, burstWeight, parentRejectWeight float32
+}
+
+func (c *counts) add(o *counts) {
+	c.granted += o.granted
+	c.notGranted += o.notGranted
+	c.burst += o.burst
+	c.parentReject += o.parentReject
+	c.grantedWeight += o.grantedWeight
+	c.notGrantedWeight += o.notGrantedWeight
+	c.burstWeight += o.burstWeight
+	c.parentRejectWeight += o.parentRejectWeight
+}
+
+// Option configures a Recorder.
+type Option func(*Recorder)
+
+// WithRetention keeps events for d, which should be at least the longest range dashboards query.
+func WithRetention(d time.Duration) Option {
+	return func(r *Recorder) {
+		r.retention = d
+	}
+}
+
+// NewRecorder returns a Recorder with no events.
+func NewRecorder(opts ...Option) *Recorder {
+	r := &Recorder{retention: DefaultRetention, now: time.Now, series: make(map[string]*series)}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+// Record counts e.
+func (r *Recorder) Record(e Event) {
+	now := r.now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	if e.Weight == 0 {
+		e.Weight = 1
+	}
+	d := dims{environment: e.Environment, guard: e.Guard, feature: e.Feature, service: e.Service, priority: e.Priority,
+		tags: make(map[string]string, len(e.Tags))}
+	if e.APIKey != "" {
+		d.keyHash = hash(e.APIKey)
+	}
+	for _, t := range e.Tags {
+		d.tags[t.GetKey()] = t.GetValue()
+	}
+	var c counts
+	if e.Granted {
+		c.granted, c.grantedWeight = 1, e.Weight
+		if e.Reason == pb.Reason_REASON_BURST || e.Reason == pb.Reason_REASON_BEST_EFFORT {
+			c.burst, c.burstWeight = 1, e.Weight
+		}
+	} else {
+		c.notGranted, c.notGrantedWeight = 1, e.Weight
+		if e.Reason == pb.Reason_REASON_INSUFFICIENT_QUOTA_PARENT {
+			c.parentReject, c.parentRejectWeight = 1, e.Weight
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.pruned) >= Resolution {
+		r.prune(now)
+	}
+	key := d.key()
+	s := r.series[key]
+	if s == nil {
+		s = &series{dims: d, buckets: make(map[int64]*counts)}
+		r.series[key] = s
+	}
+	start := minute(e.Time)
+	if s.buckets[start] == nil {
+		s.buckets[start] = &counts{}
+	}
+	s.buckets[start].add(&c)
+}
+
+// prune drops buckets which have passed the retention period, and series left with none. r.mu must be held.
+func (r *Recorder) prune(now time.Time) {
+	oldest := minute(now.Add(-r.retention))
+	for key, s := range r.series {
+		for start := range s.buckets {
+			if start < oldest {
+				delete(s.buckets, start)
+			}
+		}
+		if len(s.buckets) == 0 {
+			delete(r.series, key)
+		}
+	}
+	r.pruned = now
+}
+
+// key returns a string which is the same for equal dims, with names quoted so that separators in them can't make
+// two collide.
+func (d dims) key() string {
+	parts := []string{strconv.Quote(d.environment), strconv.Quote(d.guard), strconv.Quote(d.feature),
+		strconv.Quote(d.service), d.keyHash, strconv.Itoa(int(d.priority))}
+	return strings.Join(append(parts, tagKey(d.tags)...), ",")
+}
+
+// tagKey returns tags as sorted, quoted key=value pairs.
+func tagKey(tags map[string]string) []string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, strconv.Quote(k)+"="+strconv.Quote(v))
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// minute returns the start of t's bucket, in Unix minutes.
+func minute(t time.Time) int64 {
+	return t.Unix() / int64(Resolution/time.Second)
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,187 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/StanzaSystems/stream-demo/gen/go/stanza/hub/v1"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// describe summarises a timeseries as its axes and tags, followed by granted/not granted/burst/parent reject
+// counts for each data point.
+func describe(ts *pb.UsageTimeseries) string {
+	var parts []string
+	if ts.Guard != nil {
+		parts = append(parts, "guard="+ts.GetGuard())
+	}
+	if ts.Feature != nil {
+		parts = append(parts, "feature="+ts.GetFeature())
+	}
+	if ts.Service != nil {
+		parts = append(parts, "service="+ts.GetService())
+	}
+	if ts.Priority != nil {
+		parts = append(parts, fmt.Sprintf("priority=%d", ts.GetPriority()))
+	}
+	for _, t := range ts.GetTags() {
+		parts = append(parts, t.GetKey()+"="+t.GetValue())
+	}
+	var points []string
+	for _, p := range ts.GetData() {
+		points = append(points, fmt.Sprintf("%d/%d/%d/%d", p.GetGranted(), p.GetNotGranted(), p.GetBeBurst(), p.GetParentReject()))
+	}
+	return strings.TrimSpace(strings.Join(parts, " ") + " [" + strings.Join(points, " ") + "]")
+}
+
+func TestQuery(t *testing.T) {
+	base := time.Unix(1_000_000*60, 0)
+	r := NewRecorder()
+	r.now = func() time.Time { return base.Add(10 * time.Minute) }
+	tags := func(customer string) []*pb.Tag { return []*pb.Tag{{Key: "customer", Value: customer}} }
+	for _, e := range []Event{
+		{Time: base, Guard: "g", Feature: "search", Priority: 1, Tags: tags("a"), APIKey: "k1", Granted: true},
+		{Time: base.Add(time.Minute), Guard: "g", Feature: "search", Priority: 1, Tags: tags("b"), APIKey: "k1", Granted: true, Reason: pb.Reason_REASON_BURST, Weight: 2},
+		{Time: base.Add(6 * time.Minute), Guard: "g", Feature: "browse", Tags: tags("a"), APIKey: "k2", Reason: pb.Reason_REASON_INSUFFICIENT_QUOTA_PARENT},
+		{Time: base.Add(7 * time.Minute), Guard: "g", Feature: "browse", Tags: tags("a"), APIKey: "k2", Reason: pb.Reason_REASON_INSUFFICIENT_QUOTA},
+		{Time: base.Add(7 * time.Minute), Guard: "h", Feature: "search", Granted: true},
+		{Time: base.Add(20 * time.Minute), Guard: "g", Feature: "search", Granted: true}, // after the queries end
+	} {
+		e.Environment = "prod"
+		r.Record(e)
+	}
+	r.Record(Event{Time: base, Environment: "dev", Guard: "g", Granted: true})
+
+	report := pb.QueryMode_QUERY_MODE_REPORT.Enum()
+	tests := []struct {
+		name   string
+		req    *pb.GetUsageRequest // Environment, StartTs, EndTs and Step are filled in if unset
+		expect []string
+	}{
+		{"everything summed", &pb.GetUsageRequest{}, []string{"[2/0/1/0 1/2/0/1]"}},
+		{"one guard", &pb.GetUsageRequest{Guard: proto.String("g")}, []string{"[2/0/1/0 0/2/0/1]"}},
+		{"other environment", &pb.GetUsageRequest{Environment: "dev"}, []string{"[1/0/0/0 0/0/0/0]"}},
+		{"report features", &pb.GetUsageRequest{Guard: proto.String("g"), FeatureQueryMode: report}, []string{
+			"feature=browse [0/0/0/0 0/2/0/1]",
+			"feature=search [2/0/1/0 0/0/0/0]",
+		}},
+		{"report guards", &pb.GetUsageRequest{GuardQueryMode: report}, []string{
+			"guard=g [2/0/1/0 0/2/0/1]",
+			"guard=h [0/0/0/0 1/0/0/0]",
+		}},
+		{"tag filter", &pb.GetUsageRequest{Tags: tags("a")}, []string{"[1/0/0/0 0/2/0/1]"}},
+		{"report tags", &pb.GetUsageRequest{ReportTags: []string{"customer"}}, []string{
+			"[0/0/0/0 1/0/0/0]",
+			"customer=a [1/0/0/0 0/2/0/1]",
+			"customer=b [1/0/1/0 0/0/0/0]",
+		}},
+		{"report all tags overrides the tag filter", &pb.GetUsageRequest{ReportAllTags: proto.Bool(true), Tags: tags("b")}, []string{
+			"[0/0/0/0 1/0/0/0]",
+			"customer=a [1/0/0/0 0/2/0/1]",
+			"customer=b [1/0/1/0 0/0/0/0]",
+		}},
+		{"one priority", &pb.GetUsageRequest{Priority: proto.Int32(1), PriorityQueryMode: report}, []string{"priority=1 [2/0/1/0 0/0/0/0]"}},
+		{"one API key", &pb.GetUsageRequest{Apikey: proto.String("k2")}, []string{"[0/0/0/0 0/2/0/1]"}},
+		{"no matches", &pb.GetUsageRequest{Feature: proto.String("checkout")}, nil},
+		{"default step", &pb.GetUsageRequest{Step: proto.String("")}, []string{
+			"[1/0/0/0 1/0/1/0 0/0/0/0 0/0/0/0 0/0/0/0 0/0/0/0 0/1/0/1 1/1/0/0 0/0/0/0 0/0/0/0]",
+		}},
+		{"default range", &pb.GetUsageRequest{StartTs: &timestamppb.Timestamp{}, Step: proto.String("1h")}, []string{"[3/2/1/1]"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := proto.Clone(tt.req).(*pb.GetUsageRequest)
+			if req.Environment == "" {
+				req.Environment = "prod"
+			}
+			if req.StartTs == nil {
+				req.StartTs = timestamppb.New(base)
+				req.EndTs = timestamppb.New(base.Add(10 * time.Minute))
+			} else {
+				// Query the DefaultRange back from now.
+				req.StartTs = nil
+			}
+			if req.Step == nil {
+				req.Step = proto.String("5m")
+			} else if req.GetStep() == "" {
+				req.Step = nil
+			}
+			resp, err := r.Query(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ts := range resp.GetResult() {
+				got = append(got, describe(ts))
+			}
+			if strings.Join(got, "; ") != strings.Join(tt.expect, "; ") {
+				t.Errorf("got %q, want %q", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestQueryWeights(t *testing.T) {
+	base := time.Unix(1_000_000*60, 0)
+	r := NewRecorder()
+	r.now = func() time.Time { return base }
+	r.Record(Event{Environment: "prod", Granted: true, Reason: pb.Reason_REASON_BEST_EFFORT, Weight: 2.5})
+	r.Record(Event{Environment: "prod", Granted: true})
+	r.Record(Event{Environment: "prod", Reason: pb.Reason_REASON_INSUFFICIENT_QUOTA_PARENT, Weight: 4})
+	resp, err := r.Query(&pb.GetUsageRequest{Environment: "prod", StartTs: timestamppb.New(base), EndTs: timestamppb.New(base.Add(time.Minute))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetResult()) != 1 || len(resp.GetResult()[0].GetData()) != 1 {
+		t.Fatalf("got %v", resp)
+	}
+	p := resp.GetResult()[0].GetData()[0]
+	if p.GetGrantedWeight() != 3.5 || p.GetBeBurstWeight() != 2.5 || p.GetNotGrantedWeight() != 4 || p.GetParentRejectWeight() != 4 {
+		t.Errorf("got weights %v", p)
+	}
+	if !p.GetStartTs().AsTime().Equal(base) || !p.GetEndTs().AsTime().Equal(base.Add(time.Minute)) {
+		t.Errorf("got point from %v to %v", p.GetStartTs().AsTime(), p.GetEndTs().AsTime())
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	now := time.Unix(1_000_000*60, 0)
+	tests := []struct {
+		name string
+		req  *pb.GetUsageRequest
+	}{
+		{"no environment", &pb.GetUsageRequest{}},
+		{"start after end", &pb.GetUsageRequest{Environment: "prod", StartTs: timestamppb.New(now), EndTs: timestamppb.New(now.Add(-time.Hour))}},
+		{"step with no unit", &pb.GetUsageRequest{Environment: "prod", Step: proto.String("5")}},
+		{"step in seconds", &pb.GetUsageRequest{Environment: "prod", Step: proto.String("30s")}},
+		{"zero step", &pb.GetUsageRequest{Environment: "prod", Step: proto.String("0m")}},
+		{"step over a week", &pb.GetUsageRequest{Environment: "prod", Step: proto.String("8d")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRecorder()
+			r.now = func() time.Time { return now }
+			if _, err := r.Query(tt.req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("got %v, want %v", err, codes.InvalidArgument)
+			}
+		})
+	}
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Unix(1_000_000*60, 0)
+	r := NewRecorder(WithRetention(time.Hour))
+	r.now = func() time.Time { return now }
+	r.Record(Event{Environment: "prod", Guard: "old", Granted: true})
+	now = now.Add(2 * time.Hour)
+	r.Record(Event{Environment: "prod", Guard: "new", Granted: true})
+	if len(r.series) != 1 {
+		t.Errorf("%d series kept, want 1", len(r.series))
+	}
+}